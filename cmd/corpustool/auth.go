@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Credentials are the credentials used to talk to Quay and its registry.
+type Credentials struct {
+	// Token is a Quay OAuth application token.
+	Token string
+	// Username and Password are basic auth credentials, usually a robot
+	// account name ("org+robot") and its token.
+	Username string
+	Password string
+	// IdentityToken is an OAuth refresh token for the registry's token
+	// service, as stored by "docker login" for some registries. It's used
+	// instead of Username and Password when requesting tokens.
+	IdentityToken string
+}
+
+// APIAuth sets the Authorization header for a Quay API request.
+//
+// A token is preferred over basic credentials, as that's what the API is
+// designed around.
+func (c *Credentials) APIAuth(req *http.Request) {
+	switch {
+	case c.Token != "":
+		req.Header.Set(`Authorization`, `Bearer `+c.Token)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// RegistryAuth sets the Authorization header for a registry token request.
+//
+// Quay accepts an OAuth token as the password for the special "$oauthtoken"
+// user.
+func (c *Credentials) RegistryAuth(req *http.Request) {
+	switch {
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	case c.Token != "":
+		req.SetBasicAuth(`$oauthtoken`, c.Token)
+	}
+}
+
+// errNoCredentials is returned by loadAuthFile when the file has no entry for
+// the host.
+var errNoCredentials = errors.New("no credentials")
+
+// loadAuthFile reads the credentials for "host" from a containers
+// "auth.json" or Docker "config.json" file at "path".
+//
+// Only inline "auth" and "identitytoken" entries are supported; credential
+// helpers are not.
+func loadAuthFile(path, host string) (Credentials, error) {
+	var cr Credentials
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cr, err
+	}
+	var f struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return cr, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range f.Auths {
+		// Keys may be a bare host, a host and repository path, or (in
+		// older Docker files) a URL.
+		k = strings.TrimPrefix(k, "https://")
+		k = strings.TrimPrefix(k, "http://")
+		k, _, _ = strings.Cut(k, "/")
+		if k != host || (v.Auth == "" && v.IdentityToken == "") {
+			continue
+		}
+		cr.IdentityToken = v.IdentityToken
+		if v.Auth == "" {
+			return cr, nil
+		}
+		dec, err := base64.StdEncoding.DecodeString(v.Auth)
+		if err != nil {
+			return cr, fmt.Errorf("%s: %s: %w", path, host, err)
+		}
+		u, p, ok := strings.Cut(string(dec), ":")
+		if !ok {
+			return cr, fmt.Errorf("%s: %s: malformed auth entry", path, host)
+		}
+		cr.Username, cr.Password = u, p
+		return cr, nil
+	}
+	return cr, fmt.Errorf("%s: %w for %q", path, errNoCredentials, host)
+}
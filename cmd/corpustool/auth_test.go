@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuthFile(t *testing.T) {
+	basic := base64.StdEncoding.EncodeToString([]byte("org+robot:secret"))
+	tt := []struct {
+		Name string
+		File string
+		Want Credentials
+		// Err is the error expected, if errors.Is should match it.
+		Err error
+		// Fail expects some other error.
+		Fail bool
+	}{
+		{
+			Name: "Containers",
+			File: `{"auths": {"registry.example": {"auth": "` + basic + `"}}}`,
+			Want: Credentials{Username: "org+robot", Password: "secret"},
+		},
+		{
+			Name: "ContainersRepository",
+			File: `{"auths": {"other.example": {"auth": "b3RoZXI6b3RoZXI="}, "registry.example/org/repo": {"auth": "` + basic + `"}}}`,
+			Want: Credentials{Username: "org+robot", Password: "secret"},
+		},
+		{
+			Name: "DockerURL",
+			File: `{"auths": {"https://registry.example/v1/": {"auth": "` + basic + `"}}, "credsStore": "desktop"}`,
+			Want: Credentials{Username: "org+robot", Password: "secret"},
+		},
+		{
+			Name: "IdentityToken",
+			File: `{"auths": {"registry.example": {"identitytoken": "refresh"}}}`,
+			Want: Credentials{IdentityToken: "refresh"},
+		},
+		{
+			Name: "IdentityTokenWithAuth",
+			File: `{"auths": {"https://registry.example": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("someone:")) + `", "identitytoken": "refresh"}}}`,
+			Want: Credentials{Username: "someone", IdentityToken: "refresh"},
+		},
+		{
+			Name: "MissingHost",
+			File: `{"auths": {"other.example": {"auth": "` + basic + `"}}}`,
+			Err:  errNoCredentials,
+		},
+		{
+			Name: "EmptyEntry",
+			File: `{"auths": {"registry.example": {}}}`,
+			Err:  errNoCredentials,
+		},
+		{
+			Name: "Malformed",
+			File: `{"auths": {"registry.example": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("nocolon")) + `"}}}`,
+			Fail: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "auth.json")
+			if err := os.WriteFile(p, []byte(tc.File), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadAuthFile(p, "registry.example")
+			switch {
+			case tc.Err != nil:
+				if !errors.Is(err, tc.Err) {
+					t.Errorf("error: got: %v, want: %v", err, tc.Err)
+				}
+				return
+			case tc.Fail:
+				if err == nil {
+					t.Errorf("no error, got: %+v", got)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if got != tc.Want {
+				t.Errorf("got: %+v, want: %+v", got, tc.Want)
+			}
+		})
+	}
+}
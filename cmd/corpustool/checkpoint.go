@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// checkpoint tracks which search pages still have repositories being worked
+// on.
+//
+// Repositories are handed to the fetcher goroutines in page order but finish
+// in any order, so the page that is safe to resume from is the lowest one with
+// outstanding work.
+type checkpoint struct {
+	mu      sync.Mutex
+	pending map[int]int
+	last    int
+}
+
+func newCheckpoint(start int) *checkpoint {
+	return &checkpoint{
+		pending: make(map[int]int),
+		last:    start,
+	}
+}
+
+// Add records that a repository from "page" is being worked on.
+func (c *checkpoint) Add(page int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[page]++
+	c.last = max(c.last, page)
+}
+
+// Done records that a repository from "page" is finished and reports the page
+// a later run should resume from.
+func (c *checkpoint) Done(page int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[page]--
+	if c.pending[page] <= 0 {
+		delete(c.pending, page)
+	}
+	low := c.last
+	for p := range c.pending {
+		low = min(low, p)
+	}
+	return low
+}
+
+// saveCheckpoint records "page" as the page to resume from for the registry
+// "regID" and search query "query". The run "pass" is only recorded by the
+// first checkpoint of a pass.
+func saveCheckpoint(conn *sqlite.Conn, regID int64, query string, page int, pass int64) error {
+	return sqlitex.ExecuteFS(conn, sql.FS, "set_crawl_state.sql", &sqlitex.ExecOptions{
+		Args: []any{regID, query, page, pass},
+	})
+}
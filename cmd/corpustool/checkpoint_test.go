@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestCheckpoint(t *testing.T) {
+	tt := []struct {
+		Name  string
+		Start int
+		Add   []int
+		Done  []int
+		// Want is the resume page reported by each call to Done.
+		Want []int
+	}{
+		{
+			Name:  "InOrder",
+			Start: 1,
+			Add:   []int{1, 1, 2},
+			Done:  []int{1, 1, 2},
+			Want:  []int{1, 2, 2},
+		},
+		{
+			Name:  "LaterPageFirst",
+			Start: 1,
+			Add:   []int{1, 2, 3},
+			Done:  []int{3, 2, 1},
+			Want:  []int{1, 1, 3},
+		},
+		{
+			Name:  "Interleaved",
+			Start: 1,
+			Add:   []int{1, 2, 2, 3},
+			Done:  []int{2, 1, 3, 2},
+			Want:  []int{1, 2, 2, 3},
+		},
+		{
+			Name:  "Resumed",
+			Start: 5,
+			Add:   []int{5, 6},
+			Done:  []int{6, 5},
+			Want:  []int{5, 6},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			cp := newCheckpoint(tc.Start)
+			for _, p := range tc.Add {
+				cp.Add(p)
+			}
+			var got []int
+			for _, p := range tc.Done {
+				got = append(got, cp.Done(p))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.Want) {
+				t.Errorf("got: %v, want: %v", got, tc.Want)
+			}
+		})
+	}
+}
+
+// fakeSearch is a Quay API with "pages" pages of five repositories, each with
+// a single tag pointing at "digest". It records the search pages requested.
+type fakeSearch struct {
+	pages  int
+	digest string
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func (f *fakeSearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := r.URL.Path; {
+	case p == "/api/v1/find/repositories":
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		f.mu.Lock()
+		f.requested = append(f.requested, strconv.Itoa(page))
+		f.mu.Unlock()
+		var results []string
+		for i := range 5 {
+			name := fmt.Sprintf("repo%d-%d", page, i)
+			results = append(results, fmt.Sprintf(`{"name": %q, "namespace": {"name": "ns"}, "href": "/ns/%s"}`, name, name))
+		}
+		fmt.Fprintf(w, `{"page": %d, "has_additional": %t, "results": [%s]}`, page, page < f.pages, strings.Join(results, ", "))
+	case strings.HasPrefix(p, "/api/v1/repository/"):
+		f.mu.Lock()
+		d := cmp.Or(f.digest, "sha256:a")
+		f.mu.Unlock()
+		fmt.Fprintf(w, `{"page": 1, "has_additional": false, "tags": [{"name": "latest", "manifest_digest": %q, "is_manifest_list": true}]}`, d)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Pages returns the search pages requested since the last call.
+func (f *fakeSearch) Pages() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := strings.Join(f.requested, ",")
+	f.requested = f.requested[:0]
+	return out
+}
+
+func TestResume(t *testing.T) {
+	f := &fakeSearch{pages: 4}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	ctx := context.Background()
+	opts := Options{
+		Count:     10,
+		DB:        filepath.Join(t.TempDir(), "corpus.db"),
+		MaxAge:    time.Hour,
+		Attempts:  1,
+		Registry:  u.Host,
+		Lister:    "quay",
+		PlainHTTP: true,
+	}
+	state := func() string {
+		conn, err := sqlite.OpenConn(opts.DB, sqlite.OpenReadOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var page string
+		err = sqlitex.ExecuteTransient(conn, `SELECT page FROM crawl_state;`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				page = stmt.ColumnText(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	// Ten repositories end on the second page. The third is not requested.
+	if err := Main(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Pages(), "1,2"; got != want {
+		t.Errorf("first run pages: got: %q, want: %q", got, want)
+	}
+	if got, want := state(), "2"; got != want {
+		t.Errorf("checkpoint: got: %q, want: %q", got, want)
+	}
+
+	opts.Count = 100
+	if err := Main(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Pages(), "2,3,4"; got != want {
+		t.Errorf("second run pages: got: %q, want: %q", got, want)
+	}
+	if got := state(); got != "" {
+		t.Errorf("checkpoint not cleared: %q", got)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Comparison is the difference between the vulnerability reports of two
+// report runs.
+type Comparison struct {
+	From ReportRun `json:"from"`
+	To   ReportRun `json:"to"`
+	// Added and Removed are manifests with a report in only one of the runs,
+	// including those whose report couldn't be fetched in the other.
+	Added   []string       `json:"added"`
+	Removed []string       `json:"removed"`
+	Changed []ReportChange `json:"changed"`
+}
+
+// ReportRun identifies a report run.
+type ReportRun struct {
+	ID      int64  `json:"id"`
+	Matcher string `json:"matcher"`
+	Label   string `json:"label,omitempty"`
+}
+
+func (r *ReportRun) String() string {
+	return fmt.Sprintf("report run %d (%s)", r.ID, cmp.Or(r.Label, r.Matcher))
+}
+
+// ReportChange is a manifest whose packages or vulnerabilities differ between
+// two report runs.
+type ReportChange struct {
+	Manifest        string        `json:"manifest"`
+	Packages        bool          `json:"packages_changed"`
+	Vulnerabilities bool          `json:"vulnerabilities_changed"`
+	From            ReportSummary `json:"from"`
+	To              ReportSummary `json:"to"`
+	// AddedPackages and RemovedPackages are the packages only in the report
+	// from To and only in the one from From, and likewise for the
+	// vulnerabilities.
+	AddedPackages          []string              `json:"added_packages,omitempty"`
+	RemovedPackages        []string              `json:"removed_packages,omitempty"`
+	AddedVulnerabilities   []ReportVulnerability `json:"added_vulnerabilities,omitempty"`
+	RemovedVulnerabilities []ReportVulnerability `json:"removed_vulnerabilities,omitempty"`
+}
+
+// Empty reports whether there are no differences.
+func (c *Comparison) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// CompareOptions is the configuration for the "compare" subcommand.
+type CompareOptions struct {
+	// Format is "text" or "json".
+	Format string
+	// Old and New are the databases the runs From and To are in.
+	Old, New string
+	// From and To are report runs to compare. Zero means the most recent run
+	// for To, and for From, the run before To if both are in the same
+	// database or the most recent run otherwise.
+	From, To int64
+	// ExitCode makes any difference an error.
+	ExitCode bool
+}
+
+// compareMain parses the "compare" subcommand's flags from "args" and runs
+// it. The database "db" is used unless two databases are named.
+func compareMain(ctx context.Context, db string, args []string) error {
+	opts := CompareOptions{Old: db, New: db}
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [flags] [OLD.db NEW.db]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Format, "format", "text", "output format: text or json")
+	fs.Int64Var(&opts.From, "from", 0, "report `run` to compare from (default: the run before -to)")
+	fs.Int64Var(&opts.To, "to", 0, "report `run` to compare to (default: the latest run)")
+	fs.BoolVar(&opts.ExitCode, "exit-code", false, "exit with an error if there are any differences")
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+	case 2:
+		opts.Old, opts.New = fs.Arg(0), fs.Arg(1)
+	default:
+		fs.Usage()
+		return errors.New("compare needs zero or two databases")
+	}
+	return Compare(ctx, opts)
+}
+
+// Compare compares two report runs according to "opts" and writes the result
+// to stdout.
+func Compare(ctx context.Context, opts CompareOptions) error {
+	switch opts.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown format: %q", opts.Format)
+	}
+
+	oldConn, err := openReadOnly(ctx, opts.Old)
+	if err != nil {
+		return err
+	}
+	defer oldConn.Close()
+	newConn := oldConn
+	if opts.New != opts.Old {
+		newConn, err = openReadOnly(ctx, opts.New)
+		if err != nil {
+			return err
+		}
+		defer newConn.Close()
+	}
+	from, to, err := pickReportRuns(oldConn, newConn, opts.From, opts.To)
+	if err != nil {
+		return err
+	}
+	c, err := compareRuns(oldConn, newConn, from, to)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeComparison(w, opts.Format, c); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if opts.ExitCode && !c.Empty() {
+		return errors.New("vulnerability reports differ")
+	}
+	return nil
+}
+
+// pickReportRuns looks up the report runs "from" in the database on "oldConn"
+// and "to" in the database on "newConn", filling in defaults for zero IDs.
+func pickReportRuns(oldConn, newConn *sqlite.Conn, from, to int64) (ReportRun, ReportRun, error) {
+	var f, t ReportRun
+	oldRuns, err := loadReportRuns(oldConn)
+	if err != nil {
+		return f, t, err
+	}
+	newRuns := oldRuns
+	if newConn != oldConn {
+		if newRuns, err = loadReportRuns(newConn); err != nil {
+			return f, t, err
+		}
+	}
+	find := func(runs []ReportRun, id int64) (ReportRun, error) {
+		i := slices.IndexFunc(runs, func(r ReportRun) bool { return r.ID == id })
+		if i == -1 {
+			return ReportRun{}, fmt.Errorf("no report run %d", id)
+		}
+		return runs[i], nil
+	}
+
+	switch {
+	case to != 0:
+		t, err = find(newRuns, to)
+	case len(newRuns) == 0:
+		err = errors.New("no report runs recorded")
+	default:
+		t = newRuns[0]
+	}
+	if err != nil {
+		return f, t, err
+	}
+	switch {
+	case from != 0:
+		f, err = find(oldRuns, from)
+	case newConn != oldConn && len(oldRuns) > 0:
+		f = oldRuns[0]
+	case newConn != oldConn:
+		err = errors.New("no report runs recorded")
+	default:
+		i := slices.IndexFunc(oldRuns, func(r ReportRun) bool { return r.ID < t.ID })
+		if i == -1 {
+			return f, t, fmt.Errorf("no report run before run %d", t.ID)
+		}
+		f = oldRuns[i]
+	}
+	return f, t, err
+}
+
+// compareRuns compares the report run "from" in the database on "oldConn" with
+// "to" in the database on "newConn".
+func compareRuns(oldConn, newConn *sqlite.Conn, from, to ReportRun) (*Comparison, error) {
+	old, err := loadReports(oldConn, from.ID)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := loadReports(newConn, to.ID)
+	if err != nil {
+		return nil, err
+	}
+	c := compareReports(old, cur)
+	c.From, c.To = from, to
+	// Only the manifests that changed have their packages and
+	// vulnerabilities loaded, since there can be thousands of each.
+	for i := range c.Changed {
+		ch := &c.Changed[i]
+		oldPkgs, oldVulns, err := loadReportLists(oldConn, from.ID, ch.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		newPkgs, newVulns, err := loadReportLists(newConn, to.ID, ch.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		ch.AddedPackages, ch.RemovedPackages = diffSorted(oldPkgs, newPkgs, strings.Compare)
+		ch.AddedVulnerabilities, ch.RemovedVulnerabilities = diffSorted(oldVulns, newVulns, compareVulnerabilities)
+	}
+	return &c, nil
+}
+
+// loadReportRuns reads every report run in the database on "conn", newest
+// first.
+func loadReportRuns(conn *sqlite.Conn) ([]ReportRun, error) {
+	var out []ReportRun
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_report_runs.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out = append(out, ReportRun{
+				ID:      stmt.ColumnInt64(0),
+				Matcher: stmt.ColumnText(1),
+				Label:   stmt.ColumnText(2),
+			})
+			return nil
+		},
+	})
+	return out, err
+}
+
+// loadReports reads the report summaries of the report run "run", by manifest
+// digest. Reports that couldn't be fetched are left out.
+func loadReports(conn *sqlite.Conn, run int64) (map[string]ReportSummary, error) {
+	out := make(map[string]ReportSummary)
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_vulnerability_reports.sql", &sqlitex.ExecOptions{
+		Args: []any{run},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out[stmt.ColumnText(0)] = ReportSummary{
+				Packages: stmt.ColumnInt(1),
+				Severities: Severities{
+					Unknown:    stmt.ColumnInt(2),
+					Negligible: stmt.ColumnInt(3),
+					Low:        stmt.ColumnInt(4),
+					Medium:     stmt.ColumnInt(5),
+					High:       stmt.ColumnInt(6),
+					Critical:   stmt.ColumnInt(7),
+				},
+				PackageHash:       stmt.ColumnText(8),
+				VulnerabilityHash: stmt.ColumnText(9),
+			}
+			return nil
+		},
+	})
+	return out, err
+}
+
+// loadReportLists reads the packages and vulnerabilities recorded for the
+// manifest "digest" in the report run "run", sorted as in [ReportSummary].
+func loadReportLists(conn *sqlite.Conn, run int64, digest string) ([]string, []ReportVulnerability, error) {
+	var pkgs []string
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_report_packages.sql", &sqlitex.ExecOptions{
+		Args: []any{run, digest},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			pkgs = append(pkgs, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var vulns []ReportVulnerability
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_report_vulnerabilities.sql", &sqlitex.ExecOptions{
+		Args: []any{run, digest},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			vulns = append(vulns, ReportVulnerability{
+				Name:           stmt.ColumnText(0),
+				Package:        stmt.ColumnText(1),
+				FixedInVersion: stmt.ColumnText(2),
+				Severity:       stmt.ColumnText(3),
+			})
+			return nil
+		},
+	})
+	return pkgs, vulns, err
+}
+
+// diffSorted returns the elements only in "to" and those only in "from",
+// which are both sorted by "compare" without duplicates.
+func diffSorted[T any](from, to []T, compare func(a, b T) int) (added, removed []T) {
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch c := compare(from[i], to[j]); {
+		case c < 0:
+			removed = append(removed, from[i])
+			i++
+		case c > 0:
+			added = append(added, to[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	removed = append(removed, from[i:]...)
+	added = append(added, to[j:]...)
+	return added, removed
+}
+
+// compareReports compares the report summaries "old" and "cur".
+func compareReports(old, cur map[string]ReportSummary) Comparison {
+	c := Comparison{
+		Added:   missing(cur, old),
+		Removed: missing(old, cur),
+		Changed: []ReportChange{},
+	}
+	for d, to := range cur {
+		from, ok := old[d]
+		if !ok {
+			continue
+		}
+		ch := ReportChange{
+			Manifest:        d,
+			Packages:        from.PackageHash != to.PackageHash,
+			Vulnerabilities: from.VulnerabilityHash != to.VulnerabilityHash,
+			From:            from,
+			To:              to,
+		}
+		if ch.Packages || ch.Vulnerabilities {
+			c.Changed = append(c.Changed, ch)
+		}
+	}
+	slices.SortFunc(c.Changed, func(a, b ReportChange) int {
+		return cmp.Compare(a.Manifest, b.Manifest)
+	})
+	return c
+}
+
+// writeComparison writes "c" to "w" in the named format.
+func writeComparison(w io.Writer, format string, c *Comparison) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(c)
+	}
+	if _, err := fmt.Fprintf(w, "%s -> %s\n", &c.From, &c.To); err != nil {
+		return err
+	}
+	if c.Empty() {
+		_, err := fmt.Fprintln(w, "no differences")
+		return err
+	}
+	for _, d := range c.Added {
+		if _, err := fmt.Fprintf(w, "+ manifest %s\n", d); err != nil {
+			return err
+		}
+	}
+	for _, d := range c.Removed {
+		if _, err := fmt.Fprintf(w, "- manifest %s\n", d); err != nil {
+			return err
+		}
+	}
+	for _, ch := range c.Changed {
+		if ch.Packages {
+			_, err := fmt.Fprintf(w, "~ packages %s %d -> %d\n", ch.Manifest, ch.From.Packages, ch.To.Packages)
+			if err != nil {
+				return err
+			}
+			if err := writeItems(w, "+", ch.AddedPackages); err != nil {
+				return err
+			}
+			if err := writeItems(w, "-", ch.RemovedPackages); err != nil {
+				return err
+			}
+		}
+		if ch.Vulnerabilities {
+			_, err := fmt.Fprintf(w, "~ vulnerabilities %s %s\n", ch.Manifest, severityChanges(&ch.From.Severities, &ch.To.Severities))
+			if err != nil {
+				return err
+			}
+			if err := writeItems(w, "+", ch.AddedVulnerabilities); err != nil {
+				return err
+			}
+			if err := writeItems(w, "-", ch.RemovedVulnerabilities); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeItems writes each of "items" to "w" on an indented line of its own,
+// after "mark".
+func writeItems[T any](w io.Writer, mark string, items []T) error {
+	for _, it := range items {
+		if _, err := fmt.Fprintf(w, "  %s %v\n", mark, it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// severityChanges describes how the counts in "from" and "to" differ.
+func severityChanges(from, to *Severities) string {
+	var out []string
+	for _, s := range []struct {
+		Name     string
+		From, To int
+	}{
+		{"critical", from.Critical, to.Critical},
+		{"high", from.High, to.High},
+		{"medium", from.Medium, to.Medium},
+		{"low", from.Low, to.Low},
+		{"negligible", from.Negligible, to.Negligible},
+		{"unknown", from.Unknown, to.Unknown},
+	} {
+		if s.From != s.To {
+			out = append(out, fmt.Sprintf("%s %d -> %d", s.Name, s.From, s.To))
+		}
+	}
+	if len(out) == 0 {
+		return "same counts"
+	}
+	return strings.Join(out, ", ")
+}
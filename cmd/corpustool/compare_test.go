@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompareReports(t *testing.T) {
+	sum := func(pkgs, high int, ph, vh string) ReportSummary {
+		return ReportSummary{Packages: pkgs, Severities: Severities{High: high}, PackageHash: ph, VulnerabilityHash: vh}
+	}
+	old := map[string]ReportSummary{
+		"sha256:same":    sum(2, 1, "p1", "v1"),
+		"sha256:pkgs":    sum(2, 1, "p1", "v1"),
+		"sha256:vulns":   sum(2, 1, "p1", "v1"),
+		"sha256:removed": sum(1, 0, "p2", "v2"),
+	}
+	cur := map[string]ReportSummary{
+		"sha256:same":  sum(2, 1, "p1", "v1"),
+		"sha256:pkgs":  sum(3, 1, "p3", "v1"),
+		"sha256:vulns": sum(2, 2, "p1", "v3"),
+		"sha256:added": sum(1, 0, "p2", "v2"),
+	}
+	c := compareReports(old, cur)
+	c.From = ReportRun{ID: 1, Matcher: "http://old"}
+	c.To = ReportRun{ID: 2, Matcher: "http://new", Label: "v4.8"}
+	c.Changed[0].AddedPackages = []string{"zlib 1.2.14"}
+	c.Changed[1].AddedVulnerabilities = []ReportVulnerability{{Name: "CVE-3", Package: "zlib 1.2.13", Severity: "High"}}
+	var b strings.Builder
+	if err := writeComparison(&b, "text", &c); err != nil {
+		t.Fatal(err)
+	}
+	want := `report run 1 (http://old) -> report run 2 (v4.8)
++ manifest sha256:added
+- manifest sha256:removed
+~ packages sha256:pkgs 2 -> 3
+  + zlib 1.2.14
+~ vulnerabilities sha256:vulns high 1 -> 2
+  + CVE-3 High in zlib 1.2.13
+`
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if c := compareReports(cur, cur); !c.Empty() {
+		t.Errorf("expected no differences: %+v", c)
+	}
+}
+
+func TestDiffSorted(t *testing.T) {
+	for _, tc := range []struct {
+		Name           string
+		From, To       []string
+		Added, Removed []string
+	}{
+		{"Same", []string{"a", "b"}, []string{"a", "b"}, nil, nil},
+		{"Added", []string{"b"}, []string{"a", "b", "c"}, []string{"a", "c"}, nil},
+		{"Removed", []string{"a", "b", "c"}, []string{"b"}, nil, []string{"a", "c"}},
+		{"Replaced", []string{"a", "c"}, []string{"b", "c"}, []string{"b"}, []string{"a"}},
+		{"Empty", nil, []string{"a"}, []string{"a"}, nil},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			added, removed := diffSorted(tc.From, tc.To, strings.Compare)
+			if !slices.Equal(added, tc.Added) || !slices.Equal(removed, tc.Removed) {
+				t.Errorf("got: +%q -%q, want: +%q -%q", added, removed, tc.Added, tc.Removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Diff is the difference between two corpora.
+//
+// Namespaces are reported as "registry/namespace", repositories as
+// repository references, and tags as tag references.
+type Diff struct {
+	AddedNamespaces     []string       `json:"added_namespaces"`
+	RemovedNamespaces   []string       `json:"removed_namespaces"`
+	AddedRepositories   []string       `json:"added_repositories"`
+	RemovedRepositories []string       `json:"removed_repositories"`
+	AddedTags           []string       `json:"added_tags"`
+	RemovedTags         []string       `json:"removed_tags"`
+	ChangedTags         []DigestChange `json:"changed_tags"`
+}
+
+// DigestChange is a tag that points to a different manifest.
+type DigestChange struct {
+	Ref  string `json:"ref"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Empty reports whether there are no differences.
+func (d *Diff) Empty() bool {
+	return len(d.AddedNamespaces) == 0 && len(d.RemovedNamespaces) == 0 &&
+		len(d.AddedRepositories) == 0 && len(d.RemovedRepositories) == 0 &&
+		len(d.AddedTags) == 0 && len(d.RemovedTags) == 0 &&
+		len(d.ChangedTags) == 0
+}
+
+// DiffOptions is the configuration for the "diff" subcommand.
+type DiffOptions struct {
+	// Format is "text" or "json".
+	Format string
+	// Old and New are the databases to compare. If they're the same, the
+	// runs From and To are compared.
+	Old, New string
+	// From and To are crawl runs to compare. Zero means the most recent run
+	// for To, and the run before To for From.
+	From, To int64
+}
+
+// diffMain parses the "diff" subcommand's flags from "args" and runs it. The
+// database "db" is used unless two databases are named.
+func diffMain(ctx context.Context, db string, args []string) error {
+	opts := DiffOptions{Old: db, New: db}
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] [OLD.db NEW.db]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Format, "format", "text", "output format: text or json")
+	fs.Int64Var(&opts.From, "from", 0, "crawl `run` to compare from (default: the run before -to)")
+	fs.Int64Var(&opts.To, "to", 0, "crawl `run` to compare to (default: the latest run)")
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+	case 2:
+		opts.Old, opts.New = fs.Arg(0), fs.Arg(1)
+	default:
+		fs.Usage()
+		return errors.New("diff needs zero or two databases")
+	}
+	return DiffCorpora(ctx, opts)
+}
+
+// DiffCorpora compares two corpora according to "opts" and writes the result to
+// stdout.
+func DiffCorpora(ctx context.Context, opts DiffOptions) error {
+	switch opts.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown format: %q", opts.Format)
+	}
+
+	var d Diff
+	if opts.Old == opts.New {
+		conn, err := openReadOnly(ctx, opts.Old)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		from, to, err := pickRuns(conn, opts.From, opts.To)
+		if err != nil {
+			return err
+		}
+		if d, err = diffRuns(ctx, conn, from, to); err != nil {
+			return err
+		}
+	} else {
+		old, err := loadDB(ctx, opts.Old)
+		if err != nil {
+			return err
+		}
+		cur, err := loadDB(ctx, opts.New)
+		if err != nil {
+			return err
+		}
+		d = diffRefs(old, cur)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeDiff(w, opts.Format, &d); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// pickRuns fills in defaults for the runs "from" and "to".
+func pickRuns(conn *sqlite.Conn, from, to int64) (int64, int64, error) {
+	if from != 0 && to != 0 {
+		return from, to, nil
+	}
+	var ids []int64
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_runs.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			ids = append(ids, stmt.ColumnInt64(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if to == 0 {
+		if len(ids) == 0 {
+			return 0, 0, errors.New("no crawl runs recorded")
+		}
+		to = ids[0]
+	}
+	if from == 0 {
+		i := slices.IndexFunc(ids, func(id int64) bool { return id < to })
+		if i == -1 {
+			return 0, 0, fmt.Errorf("no crawl run before run %d", to)
+		}
+		from = ids[i]
+	}
+	return from, to, nil
+}
+
+// diffRuns compares the tags seen by the crawl runs "from" and "to".
+//
+// A run that didn't list every repository, because it was limited by -count,
+// resumed from a checkpoint, or only retried failures, says nothing about the
+// repositories it didn't get to. If either run is like that, only the
+// repositories recorded by both are compared.
+func diffRuns(ctx context.Context, conn *sqlite.Conn, from, to int64) (Diff, error) {
+	var d Diff
+	partial := false
+	for _, run := range []int64{from, to} {
+		err := sqlitex.ExecuteFS(conn, sql.FS, "get_run_complete.sql", &sqlitex.ExecOptions{
+			Args: []any{run},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if !stmt.ColumnBool(0) {
+					slog.WarnContext(ctx, "run didn't list every repository, comparing only repositories recorded by both runs", "run", run)
+					partial = true
+				}
+				return nil
+			},
+		})
+		if err != nil {
+			return d, err
+		}
+	}
+	old, err := loadRefs(conn, from)
+	if err != nil {
+		return d, err
+	}
+	cur, err := loadRefs(conn, to)
+	if err != nil {
+		return d, err
+	}
+	if partial {
+		old, cur = commonRepositories(old, cur)
+	}
+	return diffRefs(old, cur), nil
+}
+
+// commonRepositories removes the refs to repositories not in both "a" and
+// "b".
+func commonRepositories(a, b []Ref) ([]Ref, []Ref) {
+	names := func(refs []Ref) map[string]struct{} {
+		out := make(map[string]struct{})
+		for _, r := range refs {
+			out[r.Name()] = struct{}{}
+		}
+		return out
+	}
+	an, bn := names(a), names(b)
+	a = slices.DeleteFunc(a, func(r Ref) bool {
+		_, ok := bn[r.Name()]
+		return !ok
+	})
+	b = slices.DeleteFunc(b, func(r Ref) bool {
+		_, ok := an[r.Name()]
+		return !ok
+	})
+	return a, b
+}
+
+// loadDB reads the current contents of the database "db".
+func loadDB(ctx context.Context, db string) ([]Ref, error) {
+	conn, err := openReadOnly(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return loadRefs(conn, 0)
+}
+
+// diffRefs compares the corpora "old" and "cur".
+func diffRefs(old, cur []Ref) Diff {
+	var d Diff
+	keys := func(refs []Ref) (ns, repo map[string]struct{}, tag map[string]string) {
+		ns = make(map[string]struct{})
+		repo = make(map[string]struct{})
+		tag = make(map[string]string)
+		for _, r := range refs {
+			ns[r.Registry+"/"+r.Namespace] = struct{}{}
+			repo[r.Name()] = struct{}{}
+			tag[r.TagRef()] = r.Digest
+		}
+		return ns, repo, tag
+	}
+	oldNS, oldRepo, oldTag := keys(old)
+	curNS, curRepo, curTag := keys(cur)
+
+	d.AddedNamespaces = missing(curNS, oldNS)
+	d.RemovedNamespaces = missing(oldNS, curNS)
+	d.AddedRepositories = missing(curRepo, oldRepo)
+	d.RemovedRepositories = missing(oldRepo, curRepo)
+	d.AddedTags = missing(curTag, oldTag)
+	d.RemovedTags = missing(oldTag, curTag)
+	d.ChangedTags = []DigestChange{}
+	for ref, to := range curTag {
+		from, ok := oldTag[ref]
+		if ok && from != "" && to != "" && from != to {
+			d.ChangedTags = append(d.ChangedTags, DigestChange{Ref: ref, From: from, To: to})
+		}
+	}
+	slices.SortFunc(d.ChangedTags, func(a, b DigestChange) int {
+		return cmp.Compare(a.Ref, b.Ref)
+	})
+	return d
+}
+
+// missing returns the sorted keys of "a" that are not in "b".
+func missing[V any](a, b map[string]V) []string {
+	out := []string{}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// writeDiff writes "d" to "w" in the named format.
+func writeDiff(w io.Writer, format string, d *Diff) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(d)
+	}
+	if d.Empty() {
+		_, err := fmt.Fprintln(w, "no differences")
+		return err
+	}
+	sections := []struct {
+		Prefix string
+		Kind   string
+		Items  []string
+	}{
+		{"+", "namespace", d.AddedNamespaces},
+		{"-", "namespace", d.RemovedNamespaces},
+		{"+", "repository", d.AddedRepositories},
+		{"-", "repository", d.RemovedRepositories},
+		{"+", "tag", d.AddedTags},
+		{"-", "tag", d.RemovedTags},
+	}
+	for _, s := range sections {
+		for _, it := range s.Items {
+			if _, err := fmt.Fprintf(w, "%s %s %s\n", s.Prefix, s.Kind, it); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range d.ChangedTags {
+		if _, err := fmt.Fprintf(w, "~ tag %s %s -> %s\n", c.Ref, c.From, c.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRefs(t *testing.T) {
+	ref := func(ns, repo, tag, digest string) Ref {
+		return Ref{Registry: "quay.io", Namespace: ns, Repository: repo, Tag: tag, Digest: digest}
+	}
+	old := []Ref{
+		ref("a", "one", "latest", "sha256:1"),
+		ref("a", "one", "v1", "sha256:2"),
+		ref("a", "two", "latest", "sha256:3"),
+		ref("b", "three", "latest", "sha256:4"),
+	}
+	cur := []Ref{
+		ref("a", "one", "latest", "sha256:5"),
+		ref("a", "one", "v2", "sha256:6"),
+		ref("a", "two", "latest", "sha256:3"),
+		ref("c", "four", "latest", "sha256:7"),
+	}
+	got := diffRefs(old, cur)
+	want := Diff{
+		AddedNamespaces:     []string{"quay.io/c"},
+		RemovedNamespaces:   []string{"quay.io/b"},
+		AddedRepositories:   []string{"quay.io/c/four"},
+		RemovedRepositories: []string{"quay.io/b/three"},
+		AddedTags:           []string{"quay.io/a/one:v2", "quay.io/c/four:latest"},
+		RemovedTags:         []string{"quay.io/a/one:v1", "quay.io/b/three:latest"},
+		ChangedTags: []DigestChange{
+			{Ref: "quay.io/a/one:latest", From: "sha256:1", To: "sha256:5"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %+v\nwant: %+v", got, want)
+	}
+
+	if d := diffRefs(cur, cur); !d.Empty() {
+		t.Errorf("expected no differences: %+v", d)
+	}
+}
+
+func TestDiffPartialRuns(t *testing.T) {
+	f := &fakeSearch{pages: 4}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	ctx := context.Background()
+	opts := Options{
+		Count:     7,
+		DB:        filepath.Join(t.TempDir(), "corpus.db"),
+		Attempts:  1,
+		Registry:  u.Host,
+		Lister:    "quay",
+		PlainHTTP: true,
+	}
+	// The first run stops partway through the second page, and the second
+	// resumes there and sees a new digest for every tag.
+	if err := Main(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.digest = "sha256:b"
+	f.mu.Unlock()
+	opts.Count = 100
+	if err := Main(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := openReadOnly(ctx, opts.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d, err := diffRuns(ctx, conn, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed []string
+	for _, c := range d.ChangedTags {
+		changed = append(changed, c.Ref)
+	}
+	want := []string{u.Host + "/ns/repo2-0:latest", u.Host + "/ns/repo2-1:latest"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed: got: %q, want: %q", changed, want)
+	}
+	d.ChangedTags = nil
+	if !d.Empty() {
+		t.Errorf("repositories only one run got to were compared: %+v", d)
+	}
+}
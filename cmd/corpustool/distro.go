@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Media types of image configs. Manifests with any other config are artifacts
+// and aren't classified.
+const (
+	mediaTypeOCIConfig    = `application/vnd.oci.image.config.v1+json`
+	mediaTypeDockerConfig = `application/vnd.docker.container.image.v1+json`
+)
+
+// maxReleaseLayer is the largest layer downloaded to look for a release file.
+// Layers are tried smallest first, so this only gives up on images where every
+// smaller layer lacks one.
+const maxReleaseLayer = 512 << 20
+
+// osRelease is the distribution an image is built on, as found in its
+// os-release or alpine-release file.
+type osRelease struct {
+	ID        string
+	VersionID string
+}
+
+// imageDistro is what's known about the distribution of an image.
+type imageDistro struct {
+	// Platform is from the image config.
+	Platform Platform
+	// Release is nil if no release file was found.
+	Release *osRelease
+	// Layer is the layer the release file was found in.
+	Layer Descriptor
+}
+
+type fetchedDistro struct {
+	Digest string
+	*imageDistro
+}
+
+// fetchDistros classifies every single-platform manifest referenced by "tags"
+// that hasn't been classified yet, using the image manifests in "have" where
+// possible. On error, the images classified so far are returned along with it.
+func fetchDistros(ctx context.Context, reg *registry, k *known, r Repo, tags []Tag, have []fetchedManifest) ([]fetchedDistro, error) {
+	name := path.Join(r.Namespace, r.Name)
+	ms := make(map[string]*Manifest, len(have))
+	for _, m := range have {
+		ms[m.Digest] = m.Manifest
+	}
+
+	var out []fetchedDistro
+	for _, d := range imageManifests(k, tags) {
+		if !k.ClaimDistro(d) {
+			continue
+		}
+		m, ok := ms[d]
+		if !ok {
+			var err error
+			m, err = reg.ImageManifest(ctx, name, d)
+			if err != nil {
+				k.ReleaseDistro(d)
+				return out, err
+			}
+		}
+		id, err := classify(ctx, reg, k, name, m)
+		if err != nil {
+			k.ReleaseDistro(d)
+			return out, err
+		}
+		out = append(out, fetchedDistro{Digest: d, imageDistro: id})
+		l := slog.With("repository", name, "digest", d)
+		if id.Release != nil {
+			l = l.With("distro", id.Release.ID, "version", id.Release.VersionID)
+		}
+		l.DebugContext(ctx, "classified image")
+	}
+	return out, nil
+}
+
+// classify fetches the config of the image manifest "m" in the repository
+// "name", then its layers smallest first until one has a release file.
+func classify(ctx context.Context, reg *registry, k *known, name string, m *Manifest) (*imageDistro, error) {
+	out := &imageDistro{}
+	switch m.Config.MediaType {
+	case mediaTypeOCIConfig, mediaTypeDockerConfig:
+	default:
+		return out, nil
+	}
+	rc, err := reg.Blob(ctx, name, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewDecoder(io.LimitReader(rc, 16<<20)).Decode(&out.Platform)
+	if err := errors.Join(err, rc.Close()); err != nil {
+		return nil, err
+	}
+	if out.Platform.OS != "linux" {
+		return out, nil
+	}
+
+	layers := slices.Clone(m.Layers)
+	slices.SortStableFunc(layers, func(a, b Descriptor) int {
+		return cmp.Compare(a.Size, b.Size)
+	})
+	for _, l := range layers {
+		rel, ok := k.LayerRelease(l.Digest)
+		if !ok {
+			if l.Size > maxReleaseLayer {
+				break
+			}
+			rel, err = scanLayer(ctx, reg, name, l.Digest)
+			if err != nil {
+				return nil, err
+			}
+			k.SetLayerRelease(l.Digest, rel)
+		}
+		if rel != nil {
+			out.Release, out.Layer = rel, l
+			break
+		}
+	}
+	return out, nil
+}
+
+// scanLayer downloads the layer "digest" in the repository "name" and looks
+// for a release file in it. Layers that can't be read as a gzipped or plain
+// tar, such as zstd layers, are treated as not having one.
+func scanLayer(ctx context.Context, reg *registry, name, digest string) (*osRelease, error) {
+	rc, err := reg.Blob(ctx, name, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	var r io.Reader = br
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		slog.DebugContext(ctx, "skipping zstd layer", "repository", name, "digest", digest)
+		return nil, nil
+	}
+	rel, err := findRelease(tar.NewReader(r))
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) {
+		slog.DebugContext(ctx, "unreadable layer", "repository", name, "digest", digest, "reason", err)
+		return nil, nil
+	}
+	return rel, err
+}
+
+// findRelease reads the release file out of the layer "tr". "/etc/os-release"
+// is preferred, then "/usr/lib/os-release", then "/etc/alpine-release".
+func findRelease(tr *tar.Reader) (*osRelease, error) {
+	var usrLib, alpine *osRelease
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		p := path.Clean("/" + h.Name)
+		switch p {
+		case "/etc/os-release", "/usr/lib/os-release", "/etc/alpine-release":
+		default:
+			continue
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, 64<<10))
+		if err != nil {
+			return nil, err
+		}
+		switch p {
+		case "/etc/os-release":
+			return parseOSRelease(b), nil
+		case "/usr/lib/os-release":
+			usrLib = parseOSRelease(b)
+		case "/etc/alpine-release":
+			alpine = &osRelease{ID: "alpine", VersionID: strings.TrimSpace(string(b))}
+		}
+	}
+	if usrLib != nil {
+		return usrLib, nil
+	}
+	return alpine, nil
+}
+
+// parseOSRelease parses the ID and VERSION_ID out of an os-release file. The
+// ID defaults to "linux", as the file format specifies.
+func parseOSRelease(b []byte) *osRelease {
+	out := &osRelease{ID: "linux"}
+	for l := range strings.Lines(string(b)) {
+		k, v, ok := strings.Cut(strings.TrimSpace(l), "=")
+		if !ok {
+			continue
+		}
+		if u, err := strconv.Unquote(v); err == nil {
+			v = u
+		} else {
+			v = strings.Trim(v, `'`)
+		}
+		switch k {
+		case "ID":
+			out.ID = v
+		case "VERSION_ID":
+			out.VersionID = v
+		}
+	}
+	return out
+}
+
+// insertDistro records the distribution "id" of the image manifest "digest".
+func insertDistro(conn *sqlite.Conn, digest string, id *imageDistro) error {
+	// Like in insertLayers, the manifest and its layers may only be recorded
+	// by another fetcher's result that hasn't been written yet.
+	err := sqlitex.ExecuteFS(conn, sql.FS, "insert_manifest.sql", &sqlitex.ExecOptions{
+		Args: []any{digest, false},
+	})
+	if err != nil {
+		return err
+	}
+	var distro, version, layer any
+	if id.Release != nil {
+		distro, version, layer = id.Release.ID, id.Release.VersionID, id.Layer.Digest
+		err = sqlitex.ExecuteFS(conn, sql.FS, "insert_layer.sql", &sqlitex.ExecOptions{
+			Args: []any{id.Layer.Digest, id.Layer.Size},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	p := id.Platform
+	return sqlitex.ExecuteFS(conn, sql.FS, "insert_image_distro.sql", &sqlitex.ExecOptions{
+		Args: []any{digest, p.OS, p.Architecture, p.Variant, distro, version, layer},
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	for _, tc := range []struct {
+		Name, In string
+		Want     osRelease
+	}{
+		{"RHEL", "NAME=\"Red Hat Enterprise Linux\"\nID=\"rhel\"\nVERSION_ID=\"9.4\"\n", osRelease{"rhel", "9.4"}},
+		{"Debian", "PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nVERSION_ID=\"12\"\nID=debian\n", osRelease{"debian", "12"}},
+		{"SingleQuotes", "ID='ubuntu'\nVERSION_ID='22.04'\n", osRelease{"ubuntu", "22.04"}},
+		{"NoID", "NAME=Linux\n", osRelease{"linux", ""}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := *parseOSRelease([]byte(tc.In)); got != tc.Want {
+				t.Errorf("got: %+v, want: %+v", got, tc.Want)
+			}
+		})
+	}
+}
+
+// tarGz returns a gzipped tar of "files", where a value starting with "->" is
+// a symlink.
+func tarGz(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for i := 0; i < len(files); i += 2 {
+		name, body := files[i], files[i+1]
+		h := &tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(body))}
+		if target, ok := strings.CutPrefix(body, "->"); ok {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, target, 0
+			body = ""
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestClassify(t *testing.T) {
+	blobs := map[string][]byte{
+		"sha256:config": []byte(`{"architecture": "arm64", "os": "linux", "variant": "v8"}`),
+		"sha256:small":  tarGz(t, "app/main", "binary"),
+		"sha256:base": tarGz(t,
+			"./etc/os-release", "->../usr/lib/os-release",
+			"./usr/lib/os-release", "ID=fedora\nVERSION_ID=40\n",
+		),
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		d, ok := strings.CutPrefix(r.URL.Path, "/v2/ns/repo/blobs/")
+		b, found := blobs[d]
+		if !ok || !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+	reg, err := NewRegistry(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manifest{
+		MediaType: mediaTypeOCIManifest,
+		Config:    Descriptor{MediaType: mediaTypeOCIConfig, Digest: "sha256:config"},
+		Layers: []Descriptor{
+			{Digest: "sha256:base", Size: int64(len(blobs["sha256:base"]))},
+			{Digest: "sha256:small", Size: 1},
+		},
+	}
+	k := &known{releases: make(map[string]*osRelease)}
+	id, err := classify(context.Background(), reg, k, "ns/repo", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := id.Platform, (Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}); got != want {
+		t.Errorf("platform: got: %+v, want: %+v", got, want)
+	}
+	if id.Release == nil || *id.Release != (osRelease{"fedora", "40"}) || id.Layer.Digest != "sha256:base" {
+		t.Errorf("release: got: %+v in %q", id.Release, id.Layer.Digest)
+	}
+	if got, want := requests.Load(), int32(3); got != want {
+		t.Errorf("requests: got: %d, want: %d", got, want)
+	}
+
+	// Both layers are known now, so only the config is fetched.
+	requests.Store(0)
+	if _, err := classify(context.Background(), reg, k, "ns/repo", m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := requests.Load(), int32(1); got != want {
+		t.Errorf("requests: got: %d, want: %d", got, want)
+	}
+
+	t.Run("Filter", func(t *testing.T) {
+		f := Filter{Distros: []string{"fedora:4", "rhel:9"}}
+		for _, tc := range []struct {
+			id, version string
+			want        bool
+		}{
+			{"fedora", "40", false},
+			{"fedora", "4", true},
+			{"rhel", "9.4", true},
+			{"rhel", "8.10", false},
+			{"", "", false},
+		} {
+			if got := f.Release(tc.id, tc.version); got != tc.want {
+				t.Errorf("%s:%s: got: %v, want: %v", tc.id, tc.version, got, tc.want)
+			}
+		}
+	})
+}
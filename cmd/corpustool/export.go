@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Ref is a single tag in the corpus.
+type Ref struct {
+	Registry   string `json:"registry"`
+	Namespace  string `json:"namespace"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest,omitempty"`
+	// Meta is the repository's metadata, or nil if it's not known.
+	Meta *RepoMeta `json:"repository_meta,omitempty"`
+	// Distro and DistroVersion are the ID and VERSION_ID of the image's
+	// os-release file, if known.
+	Distro        string `json:"distro,omitempty"`
+	DistroVersion string `json:"distro_version,omitempty"`
+}
+
+// Name is the repository reference, without a tag or digest.
+func (r *Ref) Name() string {
+	return path.Join(r.Registry, r.Namespace, r.Repository)
+}
+
+// TagRef is the reference by tag.
+func (r *Ref) TagRef() string {
+	return r.Name() + ":" + r.Tag
+}
+
+// DigestRef is the reference by digest, or the reference by tag if the
+// digest is not known.
+func (r *Ref) DigestRef() string {
+	if r.Digest == "" {
+		return r.TagRef()
+	}
+	return r.Name() + "@" + r.Digest
+}
+
+// loadRefs reads every tag in the database on "conn".
+//
+// If "run" is not zero, the tags seen by that crawl run are returned instead,
+// with the digests they had at the time. Repository metadata is always the
+// latest recorded.
+func loadRefs(conn *sqlite.Conn, run int64) ([]Ref, error) {
+	var out []Ref
+	name, args := "export.sql", []any(nil)
+	if run != 0 {
+		name, args = "export_run.sql", []any{run}
+	}
+	err := sqlitex.ExecuteFS(conn, sql.FS, name, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			r := Ref{
+				Registry:      stmt.ColumnText(0),
+				Namespace:     stmt.ColumnText(1),
+				Repository:    stmt.ColumnText(2),
+				Tag:           stmt.ColumnText(3),
+				Digest:        stmt.ColumnText(4),
+				Distro:        stmt.ColumnText(11),
+				DistroVersion: stmt.ColumnText(12),
+			}
+			if stmt.ColumnType(6) != sqlite.TypeNull {
+				r.Meta = &RepoMeta{
+					Description:   stmt.ColumnText(5),
+					Public:        stmt.ColumnBool(6),
+					Kind:          stmt.ColumnText(7),
+					Popularity:    stmt.ColumnFloat(8),
+					NamespaceKind: stmt.ColumnText(10),
+				}
+				if stmt.ColumnType(9) != sqlite.TypeNull {
+					r.Meta.LastModified = time.Unix(stmt.ColumnInt64(9), 0).UTC()
+				}
+			}
+			out = append(out, r)
+			return nil
+		},
+	})
+	return out, err
+}
+
+// ExportOptions is the configuration for the "export" subcommand.
+type ExportOptions struct {
+	// Format is one of "text", "jsonl", or "csv".
+	Format string
+	// Output is the file to write to, or "-" for stdout.
+	Output string
+	// ByDigest writes digest references in the "text" format.
+	ByDigest bool
+	// Registry, if not empty, selects only refs from this registry host.
+	Registry string
+	// Filter selects refs by namespace, repository, and tag.
+	Filter Filter
+	// Order is one of "ref", "digest", "popularity", or "none".
+	Order string
+	// Limit, if positive, is the maximum number of refs to write.
+	Limit int
+}
+
+// exportMain parses the "export" subcommand's flags from "args" and runs it
+// against the database "db".
+func exportMain(ctx context.Context, db string, args []string) error {
+	var opts ExportOptions
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&opts.Format, "format", "text", "output format: text, jsonl, or csv")
+	fs.StringVar(&opts.Output, "o", "-", "write to `file` instead of stdout")
+	fs.BoolVar(&opts.ByDigest, "digest", false, "write references by digest in the text format")
+	fs.StringVar(&opts.Registry, "registry", "", "only export refs from registry `host`")
+	fs.Var((*listFlag)(&opts.Filter.Namespaces), "namespace", "only export these namespaces (comma-separated, repeatable)")
+	fs.Var((*listFlag)(&opts.Filter.ExcludeNamespaces), "exclude-namespace", "skip these namespaces (comma-separated, repeatable)")
+	fs.Func("repository", "only export repositories whose \"namespace/name\" matches `regexp`", regexpFlag(&opts.Filter.Repository))
+	fs.Func("tag", "only export tags matching `regexp`", regexpFlag(&opts.Filter.Tag))
+	fs.BoolVar(&opts.Filter.PublicOnly, "public", false, "only export public repositories")
+	fs.StringVar(&opts.Filter.NamespaceKind, "namespace-kind", "", "only export namespaces of this `kind`: user or organization")
+	fs.Float64Var(&opts.Filter.MinPopularity, "min-popularity", 0, "only export repositories with at least this popularity")
+	fs.Var((*listFlag)(&opts.Filter.Distros), "distro", "only export images of these distributions, as `id[:version]` (comma-separated, repeatable)")
+	fs.StringVar(&opts.Order, "order", "ref", "output order: ref, digest, popularity, or none")
+	fs.IntVar(&opts.Limit, "limit", 0, "write at most `N` refs")
+	fs.Parse(args)
+	return Export(ctx, db, opts)
+}
+
+// Export writes the refs in the database "db" according to "opts".
+func Export(ctx context.Context, db string, opts ExportOptions) error {
+	if err := checkFormat(opts.Format); err != nil {
+		return err
+	}
+	conn, err := openReadOnly(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		return err
+	}
+	refs = filterRefs(refs, opts.Registry, &opts.Filter)
+	switch opts.Order {
+	case "ref":
+		// Already sorted by the query.
+	case "digest":
+		slices.SortStableFunc(refs, func(a, b Ref) int {
+			return cmp.Compare(a.Digest, b.Digest)
+		})
+	case "popularity":
+		// Most popular first.
+		slices.SortStableFunc(refs, func(a, b Ref) int {
+			return cmp.Compare(b.popularity(), a.popularity())
+		})
+	case "none":
+	default:
+		return fmt.Errorf("unknown order: %q", opts.Order)
+	}
+	if opts.Limit > 0 && len(refs) > opts.Limit {
+		refs = refs[:opts.Limit]
+	}
+
+	return writeOutput(opts.Output, opts.Format, opts.ByDigest, refs)
+}
+
+// popularity is the repository's popularity, or zero if it's not known.
+func (r *Ref) popularity() float64 {
+	if r.Meta == nil {
+		return 0
+	}
+	return r.Meta.Popularity
+}
+
+// filterRefs removes the refs not from "registry" (if not empty) or not
+// selected by "f".
+func filterRefs(refs []Ref, registry string, f *Filter) []Ref {
+	return slices.DeleteFunc(refs, func(r Ref) bool {
+		return (registry != "" && r.Registry != registry) ||
+			!f.Repo(Repo{Namespace: r.Namespace, Name: r.Repository}) ||
+			!f.RepoMeta(r.Meta) ||
+			!f.Release(r.Distro, r.DistroVersion) ||
+			!f.TagName(r.Tag)
+	})
+}
+
+// checkFormat reports an error if "format" is not a known output format.
+func checkFormat(format string) error {
+	switch format {
+	case "text", "jsonl", "csv":
+		return nil
+	}
+	return fmt.Errorf("unknown format: %q", format)
+}
+
+// writeOutput writes "refs" to the file "name", or stdout if "name" is "-".
+func writeOutput(name, format string, byDigest bool, refs []Ref) (err error) {
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.Join(err, f.Close())
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	if err := writeRefs(bw, format, byDigest, refs); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeRefs writes "refs" to "w" in the named format.
+func writeRefs(w io.Writer, format string, byDigest bool, refs []Ref) error {
+	switch format {
+	case "text":
+		for _, r := range refs {
+			s := r.TagRef()
+			if byDigest {
+				s = r.DigestRef()
+			}
+			if _, err := fmt.Fprintln(w, s); err != nil {
+				return err
+			}
+		}
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, r := range refs {
+			v := struct {
+				Ref
+				Reference string `json:"ref"`
+			}{r, r.TagRef()}
+			if err := enc.Encode(&v); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"registry", "namespace", "repository", "tag", "digest", "ref"})
+		for _, r := range refs {
+			cw.Write([]string{r.Registry, r.Namespace, r.Repository, r.Tag, r.Digest, r.TagRef()})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown format: %q", format)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// seedExport writes a few repositories through the writer and returns the
+// path of the database.
+func seedExport(t *testing.T) string {
+	t.Helper()
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	writeResults(t, w, []*repoResult{
+		{
+			pagedRepo: pagedRepo{
+				Repo: Repo{"ns", "a"},
+				Page: 1,
+				Meta: &RepoMeta{Public: true, Kind: "repository", Popularity: 1, NamespaceKind: "organization"},
+			},
+			Tags: []Tag{
+				{Name: "latest", Digest: "sha256:c"},
+				{Name: "v1", Digest: "sha256:a"},
+			},
+		},
+		{
+			pagedRepo: pagedRepo{
+				Repo: Repo{"ns", "b"},
+				Page: 1,
+				Meta: &RepoMeta{Description: "B, \"quoted\"", Public: true, Popularity: 5},
+			},
+			Tags: []Tag{{Name: "latest", Digest: "sha256:b"}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"other", "c"}, Page: 1},
+			Tags:      []Tag{{Name: "1.0", Digest: "sha256:d"}},
+		},
+	})
+	return queryString(t, conn, `SELECT file FROM pragma_database_list WHERE name = 'main';`)
+}
+
+func TestWriteRefs(t *testing.T) {
+	db := seedExport(t)
+	conn, err := openReadOnly(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		Name     string
+		Format   string
+		ByDigest bool
+		Want     string
+	}{
+		{
+			Name:   "Text",
+			Format: "text",
+			Want: `quay.io/ns/a:latest
+quay.io/ns/a:v1
+quay.io/ns/b:latest
+quay.io/other/c:1.0
+`,
+		},
+		{
+			Name:     "TextDigest",
+			Format:   "text",
+			ByDigest: true,
+			Want: `quay.io/ns/a@sha256:c
+quay.io/ns/a@sha256:a
+quay.io/ns/b@sha256:b
+quay.io/other/c@sha256:d
+`,
+		},
+		{
+			Name:   "JSONL",
+			Format: "jsonl",
+			Want: `{"registry":"quay.io","namespace":"ns","repository":"a","tag":"latest","digest":"sha256:c","repository_meta":{"public":true,"kind":"repository","popularity":1,"namespace_kind":"organization"},"ref":"quay.io/ns/a:latest"}
+{"registry":"quay.io","namespace":"ns","repository":"a","tag":"v1","digest":"sha256:a","repository_meta":{"public":true,"kind":"repository","popularity":1,"namespace_kind":"organization"},"ref":"quay.io/ns/a:v1"}
+{"registry":"quay.io","namespace":"ns","repository":"b","tag":"latest","digest":"sha256:b","repository_meta":{"description":"B, \"quoted\"","public":true,"popularity":5,"namespace_kind":"organization"},"ref":"quay.io/ns/b:latest"}
+{"registry":"quay.io","namespace":"other","repository":"c","tag":"1.0","digest":"sha256:d","ref":"quay.io/other/c:1.0"}
+`,
+		},
+		{
+			Name:   "CSV",
+			Format: "csv",
+			Want: `registry,namespace,repository,tag,digest,ref
+quay.io,ns,a,latest,sha256:c,quay.io/ns/a:latest
+quay.io,ns,a,v1,sha256:a,quay.io/ns/a:v1
+quay.io,ns,b,latest,sha256:b,quay.io/ns/b:latest
+quay.io,other,c,1.0,sha256:d,quay.io/other/c:1.0
+`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeRefs(&b, tc.Format, tc.ByDigest, refs); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tc.Want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	db := seedExport(t)
+	tt := []struct {
+		Name string
+		Opts ExportOptions
+		Want string
+	}{
+		{
+			Name: "Ref",
+			Opts: ExportOptions{Order: "ref"},
+			Want: "quay.io/ns/a:latest quay.io/ns/a:v1 quay.io/ns/b:latest quay.io/other/c:1.0",
+		},
+		{
+			Name: "Digest",
+			Opts: ExportOptions{Order: "digest"},
+			Want: "quay.io/ns/a:v1 quay.io/ns/b:latest quay.io/ns/a:latest quay.io/other/c:1.0",
+		},
+		{
+			// Ties keep the ref order, and unknown popularity sorts last.
+			Name: "Popularity",
+			Opts: ExportOptions{Order: "popularity"},
+			Want: "quay.io/ns/b:latest quay.io/ns/a:latest quay.io/ns/a:v1 quay.io/other/c:1.0",
+		},
+		{
+			Name: "Limit",
+			Opts: ExportOptions{Order: "popularity", Limit: 2},
+			Want: "quay.io/ns/b:latest quay.io/ns/a:latest",
+		},
+		{
+			// The limit applies after filtering.
+			Name: "FilteredLimit",
+			Opts: ExportOptions{Order: "digest", Limit: 1, Filter: Filter{ExcludeNamespaces: []string{"ns"}}},
+			Want: "quay.io/other/c:1.0",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			opts := tc.Opts
+			opts.Format = "text"
+			opts.Output = filepath.Join(t.TempDir(), "refs.txt")
+			if err := Export(context.Background(), db, opts); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(strings.Fields(string(b)), " "); got != tc.Want {
+				t.Errorf("got:  %s\nwant: %s", got, tc.Want)
+			}
+		})
+	}
+
+	if err := Export(context.Background(), db, ExportOptions{Format: "text", Order: "size"}); err == nil {
+		t.Error("unknown order: no error")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ResponseError is returned for an HTTP response with an unexpected status.
+type ResponseError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ResponseError) Error() string {
+	return "unexpected response: " + e.Status
+}
+
+func responseError(res *http.Response) error {
+	return &ResponseError{StatusCode: res.StatusCode, Status: res.Status}
+}
+
+// ErrorBudget is how many repositories may fail before a crawl gives up.
+//
+// It is either a count, or a percentage of the repositories processed so far.
+// A percentage is only enforced once a single failure fits within it, so that
+// one early failure doesn't end the crawl.
+type ErrorBudget struct {
+	Limit   float64
+	Percent bool
+}
+
+func (b *ErrorBudget) String() string {
+	if b == nil {
+		return ""
+	}
+	s := strconv.FormatFloat(b.Limit, 'f', -1, 64)
+	if b.Percent {
+		s += "%"
+	}
+	return s
+}
+
+func (b *ErrorBudget) Set(v string) error {
+	n, pct := strings.CutSuffix(strings.TrimSpace(v), "%")
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 {
+		return fmt.Errorf("negative error budget: %q", v)
+	}
+	if !pct && f != float64(int(f)) {
+		return fmt.Errorf("error budget must be a count or a percentage: %q", v)
+	}
+	b.Limit, b.Percent = f, pct
+	return nil
+}
+
+// Exceeded reports whether "failed" failures out of "total" repositories is
+// over the budget.
+func (b *ErrorBudget) Exceeded(failed, total int) bool {
+	switch {
+	case !b.Percent:
+		return float64(failed) > b.Limit
+	case b.Limit == 0:
+		return failed > 0
+	case float64(total)*b.Limit < 100:
+		return false
+	default:
+		return float64(failed)*100 > b.Limit*float64(total)
+	}
+}
+
+// insertFetchError records that fetching the repository "rID" in the
+// namespace "nsID" failed with "err".
+func (w *writer) insertFetchError(nsID, rID int64, err error) error {
+	var status any
+	if re := (*ResponseError)(nil); errors.As(err, &re) {
+		status = re.StatusCode
+	}
+	return sqlitex.ExecuteFS(w.conn, sql.FS, "insert_fetch_error.sql", &sqlitex.ExecOptions{
+		Args: []any{w.runID, w.regID, nsID, rID, status, err.Error()},
+	})
+}
+
+// loadFailed returns the repositories in the registry "regID" whose last fetch
+// failed.
+func loadFailed(conn *sqlite.Conn, regID int64) ([]Repo, error) {
+	var out []Repo
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_failed_repositories.sql", &sqlitex.ExecOptions{
+		Args: []any{regID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out = append(out, Repo{Namespace: stmt.ColumnText(0), Name: stmt.ColumnText(1)})
+			return nil
+		},
+	})
+	return out, err
+}
+
+// failedLister lists a fixed set of repositories, all on one page, and
+// delegates everything else.
+type failedLister struct {
+	Lister
+	repos []Repo
+}
+
+func (l *failedLister) Repositories(ctx context.Context, _ int) (iter.Seq[pagedRepo], func() error) {
+	return func(yield func(pagedRepo) bool) {
+			for _, r := range l.repos {
+				if !yield(pagedRepo{Repo: r, Page: 1}) {
+					return
+				}
+			}
+		}, func() error {
+			return nil
+		}
+}
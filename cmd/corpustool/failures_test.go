@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestErrorBudget(t *testing.T) {
+	for _, tc := range []struct {
+		Budget   string
+		Failed   int
+		Total    int
+		Exceeded bool
+	}{
+		{"0", 0, 10, false},
+		{"0", 1, 10, true},
+		{"10", 10, 10, false},
+		{"10", 11, 100, true},
+		{"0%", 1, 1000, true},
+		{"5%", 1, 1, false},   // one failure is 100%, but too few to tell
+		{"5%", 1, 19, false},  // still too few
+		{"5%", 2, 20, true},   // 10%
+		{"5%", 5, 100, false}, // exactly 5%
+		{"5%", 6, 100, true},
+		{"0.5%", 1, 200, false},
+		{"0.5%", 2, 200, true},
+	} {
+		var b ErrorBudget
+		if err := b.Set(tc.Budget); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := b.Exceeded(tc.Failed, tc.Total), tc.Exceeded; got != want {
+			t.Errorf("%s, %d of %d: got: %v, want: %v", tc.Budget, tc.Failed, tc.Total, got, want)
+		}
+		if got, want := b.String(), tc.Budget; got != want {
+			t.Errorf("String: got: %q, want: %q", got, want)
+		}
+	}
+
+	for _, bad := range []string{"", "-1", "1.5", "x%"} {
+		var b ErrorBudget
+		if err := b.Set(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
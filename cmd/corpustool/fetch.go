@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// known is what the database already holds, loaded once at the start of a
+// crawl so that fetchers can decide what to skip without touching the
+// database.
+type known struct {
+	mu sync.Mutex
+	// fetched is when each repository was last fetched.
+	fetched map[Repo]int64
+	// children maps resolved manifest lists to their single-platform
+	// children. A nil entry is a list some fetcher has claimed.
+	children map[string][]string
+	// layered is the set of manifests with recorded layers, or claimed by
+	// some fetcher.
+	layered map[string]struct{}
+	// classified is the set of manifests with a recorded distribution, or
+	// claimed by some fetcher.
+	classified map[string]struct{}
+	// releases maps layers to the release file found in them. A nil entry
+	// is a layer without one.
+	releases map[string]*osRelease
+}
+
+// loadKnown reads the fetch times for the registry "regID" and the manifests
+// that are already resolved, layered, or classified.
+func loadKnown(conn *sqlite.Conn, regID int64) (*known, error) {
+	k := &known{
+		fetched:    make(map[Repo]int64),
+		children:   make(map[string][]string),
+		layered:    make(map[string]struct{}),
+		classified: make(map[string]struct{}),
+		releases:   make(map[string]*osRelease),
+	}
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_fetched_repositories.sql", &sqlitex.ExecOptions{
+		Args: []any{regID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			r := Repo{Namespace: stmt.ColumnText(0), Name: stmt.ColumnText(1)}
+			k.fetched[r] = stmt.ColumnInt64(2)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_resolved_lists.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			p := stmt.ColumnText(0)
+			cs := k.children[p]
+			if cs == nil {
+				cs = []string{}
+			}
+			if !stmt.ColumnBool(2) {
+				cs = append(cs, stmt.ColumnText(1))
+			}
+			k.children[p] = cs
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_layered_manifests.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			k.layered[stmt.ColumnText(0)] = struct{}{}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_classified_manifests.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			k.classified[stmt.ColumnText(0)] = struct{}{}
+			if l := stmt.ColumnText(1); l != "" {
+				k.releases[l] = &osRelease{ID: stmt.ColumnText(2), VersionID: stmt.ColumnText(3)}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// FetchedAt reports when the repository "r" was last fetched, as a Unix time.
+func (k *known) FetchedAt(r Repo) int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.fetched[r]
+}
+
+// ClaimList reports whether the manifest list "d" still needs resolving. Only
+// the first caller for a given digest gets true.
+func (k *known) ClaimList(d string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.children[d]; ok {
+		return false
+	}
+	k.children[d] = nil
+	return true
+}
+
+// SetChildren records the single-platform children of the manifest list "d".
+func (k *known) SetChildren(d string, cs []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.children[d] = append([]string{}, cs...)
+}
+
+// Release gives up the claims made for "res", so that the manifests it
+// fetched are fetched again by someone else. It's used when the rest of the
+// result is thrown away.
+func (k *known) Release(res *repoResult) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, idx := range res.Indexes {
+		delete(k.children, idx.Digest)
+	}
+	for _, m := range res.Manifests {
+		delete(k.layered, m.Digest)
+	}
+	for _, d := range res.Distros {
+		delete(k.classified, d.Digest)
+	}
+}
+
+// ReleaseList gives up the claim on the manifest list "d".
+func (k *known) ReleaseList(d string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.children, d)
+}
+
+// ReleaseManifest gives up the claim on the manifest "d".
+func (k *known) ReleaseManifest(d string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.layered, d)
+}
+
+// Children returns the single-platform children of the manifest list "d", or
+// nil if it has not been resolved.
+func (k *known) Children(d string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.children[d]
+}
+
+// ClaimManifest reports whether the layers of the manifest "d" still need
+// recording. Only the first caller for a given digest gets true.
+func (k *known) ClaimManifest(d string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.layered[d]; ok {
+		return false
+	}
+	k.layered[d] = struct{}{}
+	return true
+}
+
+// ClaimDistro reports whether the distribution of the manifest "d" still
+// needs recording. Only the first caller for a given digest gets true.
+func (k *known) ClaimDistro(d string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.classified[d]; ok {
+		return false
+	}
+	k.classified[d] = struct{}{}
+	return true
+}
+
+// ReleaseDistro gives up the claim on the distribution of the manifest "d".
+func (k *known) ReleaseDistro(d string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.classified, d)
+}
+
+// LayerRelease reports the release file found in the layer "d", and whether
+// the layer has been looked at.
+func (k *known) LayerRelease(d string) (*osRelease, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rel, ok := k.releases[d]
+	return rel, ok
+}
+
+// SetLayerRelease records the release file found in the layer "d", or nil if
+// there was none.
+func (k *known) SetLayerRelease(d string, rel *osRelease) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.releases[d] = rel
+}
+
+// repoResult is everything fetched for one repository, handed from a fetcher
+// to the writer.
+type repoResult struct {
+	pagedRepo
+	// Skipped is set when the repository was fetched recently enough that
+	// its tags are carried over as-is.
+	Skipped bool
+	Tags    []Tag
+	// Indexes are the manifest lists resolved for this repository.
+	Indexes []fetchedIndex
+	// Manifests are the image manifests whose layers were fetched for this
+	// repository.
+	Manifests []fetchedManifest
+	// Distros are the images classified for this repository.
+	Distros []fetchedDistro
+	// Err is set if fetching the repository failed. Nothing else but the
+	// repository is set in that case.
+	Err error
+}
+
+type fetchedIndex struct {
+	Digest string
+	*Index
+}
+
+type fetchedManifest struct {
+	Digest string
+	*Manifest
+}
+
+// fetcher does the HTTP side of a crawl. It never touches the database.
+type fetcher struct {
+	ls     Lister
+	reg    *registry
+	known  *known
+	opts   *Options
+	cutoff int64
+}
+
+// Fetch gathers the tags, and depending on the options, the manifest lists,
+// image manifests, and distributions of the repository "pr".
+func (f *fetcher) Fetch(ctx context.Context, pr pagedRepo) (*repoResult, error) {
+	res := &repoResult{pagedRepo: pr}
+	r := pr.Repo
+	l := slog.With(
+		"namespace", r.Namespace,
+		"repository", r.Name,
+	)
+
+	if fetched := f.known.FetchedAt(r); fetched > f.cutoff {
+		l.DebugContext(ctx, "skipping recently fetched repository", "fetched", time.Unix(fetched, 0))
+		res.Skipped = true
+		return res, nil
+	}
+
+	seq, check := f.ls.Tags(ctx, r)
+	now := time.Now()
+	res.Tags = slices.Collect(func(yield func(Tag) bool) {
+		for t := range seq {
+			if !f.opts.Filter.TagMeta(&t, now) {
+				continue
+			}
+			if !yield(t) {
+				return
+			}
+		}
+	})
+	if err := check(); err != nil {
+		return nil, err
+	}
+	if len(res.Tags) == 0 {
+		l.DebugContext(ctx, "no tags found")
+	}
+
+	var err error
+	if f.opts.Resolve {
+		res.Indexes, err = fetchLists(ctx, f.reg, f.known, r, res.Tags)
+		if err != nil {
+			f.known.Release(res)
+			return nil, err
+		}
+	}
+	if f.opts.Layers {
+		res.Manifests, err = fetchLayers(ctx, f.reg, f.known, r, res.Tags)
+		if err != nil {
+			f.known.Release(res)
+			return nil, err
+		}
+	}
+	if f.opts.OSRelease {
+		res.Distros, err = fetchDistros(ctx, f.reg, f.known, r, res.Tags, res.Manifests)
+		if err != nil {
+			f.known.Release(res)
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Filter selects which repositories and tags are crawled.
+//
+// The zero value selects everything.
+type Filter struct {
+	// Namespaces, if not empty, is the set of namespaces to crawl.
+	Namespaces []string
+	// ExcludeNamespaces is a set of namespaces to skip.
+	ExcludeNamespaces []string
+	// Repository, if not nil, must match "namespace/name" for a repository
+	// to be crawled.
+	Repository *regexp.Regexp
+	// Tag, if not nil, must match a tag name for it to be recorded.
+	Tag *regexp.Regexp
+	// ModifiedWithin, if not zero, skips tags last modified longer ago than
+	// this. Tags without a modification time are kept.
+	ModifiedWithin time.Duration
+	// SkipExpiring skips tags that have an expiration set.
+	SkipExpiring bool
+	// ManifestKind selects tags by the kind of manifest they point to:
+	// "list", "single", or "both". Empty is the same as "both".
+	ManifestKind string
+	// PublicOnly skips repositories that aren't public.
+	PublicOnly bool
+	// NamespaceKind, if not empty, selects namespaces of this kind: "user" or
+	// "organization".
+	NamespaceKind string
+	// MinPopularity skips repositories less popular than this.
+	MinPopularity float64
+	// Distros, if not empty, selects images of these distributions, as "id"
+	// or "id:version". A version matches itself and any version it's a
+	// prefix of, so "rhel:9" matches "9.4".
+	Distros []string
+}
+
+// Repo reports whether the repository "r" should be crawled.
+func (f *Filter) Repo(r Repo) bool {
+	if len(f.Namespaces) != 0 && !slices.Contains(f.Namespaces, r.Namespace) {
+		return false
+	}
+	if slices.Contains(f.ExcludeNamespaces, r.Namespace) {
+		return false
+	}
+	if f.Repository != nil && !f.Repository.MatchString(path.Join(r.Namespace, r.Name)) {
+		return false
+	}
+	return true
+}
+
+// RepoMeta reports whether a repository with the metadata "m" should be
+// selected. Repositories without metadata are kept.
+func (f *Filter) RepoMeta(m *RepoMeta) bool {
+	switch {
+	case m == nil:
+		return true
+	case f.PublicOnly && !m.Public:
+		return false
+	case f.NamespaceKind != "" && m.NamespaceKind != "" && m.NamespaceKind != f.NamespaceKind:
+		return false
+	case m.Popularity < f.MinPopularity:
+		return false
+	}
+	return true
+}
+
+// Release reports whether an image of the distribution "id" at "version"
+// should be selected. Unlike the other metadata, an unknown distribution is
+// never selected by a non-empty filter.
+func (f *Filter) Release(id, version string) bool {
+	if len(f.Distros) == 0 {
+		return true
+	}
+	for _, d := range f.Distros {
+		wid, wv, ok := strings.Cut(d, ":")
+		if wid != id {
+			continue
+		}
+		if !ok || version == wv || strings.HasPrefix(version, wv+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// TagName reports whether the tag "name" should be recorded.
+func (f *Filter) TagName(name string) bool {
+	return f.Tag == nil || f.Tag.MatchString(name)
+}
+
+// TagMeta reports whether the tag "t" should be recorded, going by its name
+// and metadata, as of "now".
+func (f *Filter) TagMeta(t *Tag, now time.Time) bool {
+	if !f.TagName(t.Name) {
+		return false
+	}
+	switch f.ManifestKind {
+	case "list":
+		if !t.IsList {
+			return false
+		}
+	case "single":
+		if t.IsList {
+			return false
+		}
+	}
+	if f.SkipExpiring && !t.Expiration.IsZero() {
+		return false
+	}
+	if f.ModifiedWithin != 0 && !t.LastModified.IsZero() && now.Sub(t.LastModified) > f.ModifiedWithin {
+		return false
+	}
+	return true
+}
+
+// Empty reports whether the filter selects everything.
+func (f *Filter) Empty() bool {
+	return len(f.Namespaces) == 0 && len(f.ExcludeNamespaces) == 0 &&
+		f.Repository == nil && f.Tag == nil &&
+		f.ModifiedWithin == 0 && !f.SkipExpiring &&
+		(f.ManifestKind == "" || f.ManifestKind == "both") &&
+		!f.PublicOnly && f.NamespaceKind == "" && f.MinPopularity == 0 &&
+		len(f.Distros) == 0
+}
+
+// listFlag is a [flag.Value] that accumulates comma-separated values across
+// repeated uses.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	for s := range strings.SplitSeq(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// regexpFlag returns a function for [flag.Func] that compiles the value into
+// "re".
+func regexpFlag(re **regexp.Regexp) func(string) error {
+	return func(v string) (err error) {
+		*re, err = regexp.Compile(v)
+		return err
+	}
+}
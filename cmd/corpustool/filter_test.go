@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilterRepo(t *testing.T) {
+	repos := []Repo{
+		{"library", "alpine"},
+		{"library", "busybox"},
+		{"org", "app"},
+		{"org", "app-ci"},
+		{"user", "app"},
+	}
+	tt := []struct {
+		Name   string
+		Filter Filter
+		Want   []string
+	}{
+		{
+			Name: "Empty",
+			Want: []string{"library/alpine", "library/busybox", "org/app", "org/app-ci", "user/app"},
+		},
+		{
+			Name:   "Namespaces",
+			Filter: Filter{Namespaces: []string{"library", "user"}},
+			Want:   []string{"library/alpine", "library/busybox", "user/app"},
+		},
+		{
+			Name:   "Exclude",
+			Filter: Filter{ExcludeNamespaces: []string{"library"}},
+			Want:   []string{"org/app", "org/app-ci", "user/app"},
+		},
+		{
+			Name:   "ExcludeWins",
+			Filter: Filter{Namespaces: []string{"library", "org"}, ExcludeNamespaces: []string{"org"}},
+			Want:   []string{"library/alpine", "library/busybox"},
+		},
+		{
+			// The pattern is matched against "namespace/name", unanchored.
+			Name:   "Repository",
+			Filter: Filter{Repository: regexp.MustCompile(`/app$`)},
+			Want:   []string{"org/app", "user/app"},
+		},
+		{
+			Name:   "RepositoryAndNamespaces",
+			Filter: Filter{Namespaces: []string{"org"}, Repository: regexp.MustCompile(`app`)},
+			Want:   []string{"org/app", "org/app-ci"},
+		},
+		{
+			Name:   "RepositoryExcluded",
+			Filter: Filter{ExcludeNamespaces: []string{"user"}, Repository: regexp.MustCompile(`app`)},
+			Want:   []string{"org/app", "org/app-ci"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var got []string
+			for _, r := range repos {
+				if tc.Filter.Repo(r) {
+					got = append(got, r.Namespace+"/"+r.Name)
+				}
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("got: %q, want: %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestFilterTagName(t *testing.T) {
+	tags := []string{"latest", "v1", "v1.2", "v1.2-ci", "sha256-abc.sig"}
+	tt := []struct {
+		Name string
+		Tag  string
+		Want []string
+	}{
+		{
+			Name: "Empty",
+			Want: tags,
+		},
+		{
+			Name: "Unanchored",
+			Tag:  `v1`,
+			Want: []string{"v1", "v1.2", "v1.2-ci"},
+		},
+		{
+			Name: "Anchored",
+			Tag:  `^v\d+(\.\d+)*$`,
+			Want: []string{"v1", "v1.2"},
+		},
+		{
+			Name: "Negated",
+			Tag:  `^[^s]`,
+			Want: []string{"latest", "v1", "v1.2", "v1.2-ci"},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var f Filter
+			if tc.Tag != "" {
+				f.Tag = regexp.MustCompile(tc.Tag)
+			}
+			var got []string
+			for _, n := range tags {
+				// TagMeta goes by the name first.
+				if f.TagMeta(&Tag{Name: n}, time.Time{}) != f.TagName(n) {
+					t.Errorf("%s: TagMeta and TagName disagree", n)
+				}
+				if f.TagName(n) {
+					got = append(got, n)
+				}
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("got: %q, want: %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestFilterEmpty(t *testing.T) {
+	if f := (Filter{}); !f.Empty() {
+		t.Error("zero filter: not empty")
+	}
+	if f := (Filter{ManifestKind: "both"}); !f.Empty() {
+		t.Error("both manifest kinds: not empty")
+	}
+	for _, f := range []Filter{
+		{Namespaces: []string{"org"}},
+		{ExcludeNamespaces: []string{"org"}},
+		{Repository: regexp.MustCompile(`.`)},
+		{Tag: regexp.MustCompile(`.`)},
+		{ModifiedWithin: time.Hour},
+		{SkipExpiring: true},
+		{ManifestKind: "list"},
+		{PublicOnly: true},
+		{NamespaceKind: "user"},
+		{MinPopularity: 1},
+		{Distros: []string{"rhel"}},
+	} {
+		if f.Empty() {
+			t.Errorf("%+v: empty", f)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	var f Filter
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var((*listFlag)(&f.Namespaces), "namespace", "")
+	fs.Func("tag", "", regexpFlag(&f.Tag))
+	err := fs.Parse([]string{"-namespace", "library, org", "-namespace", "user,", "-namespace", " ", "-tag", `^v\d`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"library", "org", "user"}; !slices.Equal(f.Namespaces, want) {
+		t.Errorf("namespaces: got: %q, want: %q", f.Namespaces, want)
+	}
+	if got := (*listFlag)(&f.Namespaces).String(); got != "library,org,user" {
+		t.Errorf("namespaces: String: got: %q", got)
+	}
+	if f.Tag == nil || f.Tag.String() != `^v\d` {
+		t.Errorf("tag: got: %v", f.Tag)
+	}
+
+	if err := fs.Parse([]string{"-tag", `v(`}); err == nil {
+		t.Error("bad tag pattern: no error")
+	}
+}
@@ -1,25 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"hash/maphash"
-	"io"
 	"iter"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
-	"slices"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/quay/clair-workflows/cmd/corpustool/sql"
 	"golang.org/x/sync/errgroup"
@@ -58,10 +55,68 @@ func main() {
 	})
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to `file`")
 	memprofile := flag.String("memprofile", "", "write memory profile to `file`")
-	fetchCount := flag.Int("count", 500, "number of repository objects to fetch")
-	dbURI := flag.String("db", "corpus.db", "database to write to")
+	var opts Options
+	flag.IntVar(&opts.Count, "count", 500, "number of repository objects to fetch")
+	flag.StringVar(&opts.DB, "db", "corpus.db", "database to use")
+	flag.DurationVar(&opts.MaxAge, "max-age", 12*time.Hour, "skip repositories fetched more recently than `duration`")
+	flag.BoolVar(&opts.Restart, "restart", false, "ignore any saved checkpoint and start paging from the first page")
+	flag.BoolVar(&opts.Resolve, "resolve", true, "resolve manifest lists into per-platform manifests")
+	flag.BoolVar(&opts.Layers, "layers", true, "fetch image manifests to record their layers")
+	flag.BoolVar(&opts.OSRelease, "os-release", false, "fetch image configs and the layer with the os-release file to record each image's distribution")
+	flag.IntVar(&opts.Attempts, "attempts", 5, "number of attempts for each HTTP request")
+	flag.DurationVar(&opts.Timeout, "timeout", time.Minute, "timeout for each HTTP request attempt, or for blobs, until the response starts")
+	flag.StringVar(&opts.Auth.Token, "token", "", "Quay API token (also taken from QUAY_TOKEN environment variable)")
+	flag.StringVar(&opts.Auth.Username, "robot", "", "robot account `name` to authenticate as")
+	flag.StringVar(&opts.Auth.Password, "robot-token", "", "robot account token (also taken from QUAY_ROBOT_TOKEN environment variable)")
+	flag.StringVar(&opts.Registry, "registry", "quay.io", "registry `host` to crawl")
+	flag.StringVar(&opts.Lister, "lister", "quay", "API used to list repositories and tags: quay or distribution")
+	flag.BoolVar(&opts.PlainHTTP, "plain-http", false, "use HTTP instead of HTTPS to talk to the registry")
+	flag.StringVar(&opts.Query, "query", "*", "repository search `query` (quay lister only)")
+	flag.BoolVar(&opts.Shard, "shard", false, "split the search into name prefixes to get past the limit on search results (quay lister only)")
+	flag.Var((*listFlag)(&opts.Filter.Namespaces), "namespace", "only crawl these namespaces (comma-separated, repeatable)")
+	flag.Var((*listFlag)(&opts.Filter.ExcludeNamespaces), "exclude-namespace", "skip these namespaces (comma-separated, repeatable)")
+	flag.Func("repository", "only crawl repositories whose \"namespace/name\" matches `regexp`", regexpFlag(&opts.Filter.Repository))
+	flag.Func("tag", "only record tags matching `regexp`", regexpFlag(&opts.Filter.Tag))
+	flag.DurationVar(&opts.Filter.ModifiedWithin, "modified-within", 0, "only record tags modified within `duration` (quay lister only)")
+	flag.BoolVar(&opts.Filter.SkipExpiring, "skip-expiring", false, "skip tags that have an expiration set (quay lister only)")
+	flag.StringVar(&opts.Filter.ManifestKind, "manifest-kind", "both", "only record tags pointing at manifests of this `kind`: list, single, or both")
+	flag.IntVar(&opts.Workers, "workers", runtime.GOMAXPROCS(0), "number of repositories to fetch concurrently")
+	flag.IntVar(&opts.Batch, "batch", 100, "number of repositories to commit in one transaction")
+	opts.Budget = ErrorBudget{Limit: 10}
+	flag.Var(&opts.Budget, "error-budget", "give up after more than `N` repositories fail, or more than N% of them")
+	flag.BoolVar(&opts.RetryFailed, "retry-failed", false, "only refetch the repositories whose last fetch failed")
+	authfile := flag.String("authfile", os.Getenv("REGISTRY_AUTH_FILE"), "read credentials from a containers auth.json or docker config.json `file`")
+	flag.Usage = usage
 	flag.Parse()
 
+	if opts.Auth.Token == "" {
+		opts.Auth.Token = os.Getenv("QUAY_TOKEN")
+	}
+	if opts.Auth.Username != "" && opts.Auth.Password == "" {
+		opts.Auth.Password = os.Getenv("QUAY_ROBOT_TOKEN")
+	}
+	if opts.Auth.Username == "" && *authfile != "" {
+		// A file named on the command line is expected to have credentials
+		// for the registry; one from the environment may be for other
+		// registries.
+		explicit := false
+		flag.Visit(func(f *flag.Flag) {
+			explicit = explicit || f.Name == "authfile"
+		})
+		cr, err := loadAuthFile(*authfile, opts.Registry)
+		switch {
+		case errors.Is(err, errNoCredentials) && !explicit:
+			slog.Warn("REGISTRY_AUTH_FILE has no credentials for the registry, continuing anonymously", "reason", err)
+		case err != nil:
+			slog.Error("unable to load credentials", "reason", err)
+			code = 1
+			return
+		default:
+			opts.Auth.Username, opts.Auth.Password = cr.Username, cr.Password
+			opts.Auth.IdentityToken = cr.IdentityToken
+		}
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -90,151 +145,345 @@ func main() {
 		}
 	}()
 
-	if err := Main(ctx, *fetchCount, *dbURI); err != nil {
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "", "crawl":
+		err = Main(ctx, opts)
+	case "export":
+		err = exportMain(ctx, opts.DB, flag.Args()[1:])
+	case "sample":
+		err = sampleMain(ctx, opts.DB, flag.Args()[1:])
+	case "diff":
+		err = diffMain(ctx, opts.DB, flag.Args()[1:])
+	case "runs":
+		err = runsMain(ctx, opts.DB, flag.Args()[1:])
+	case "prune":
+		err = pruneMain(ctx, opts.DB, flag.Args()[1:])
+	case "mirror":
+		err = mirrorMain(ctx, &opts, flag.Args()[1:])
+	case "submit":
+		err = submitMain(ctx, &opts, flag.Args()[1:])
+	case "vulns":
+		err = vulnsMain(ctx, &opts, flag.Args()[1:])
+	case "compare":
+		err = compareMain(ctx, opts.DB, flag.Args()[1:])
+	case "migrate":
+		err = migrateMain(ctx, opts.DB)
+	default:
+		err = fmt.Errorf("unknown command: %q", cmd)
+	}
+	if err != nil {
 		slog.Error("exiting", "reason", err)
 		code = 1
 	}
 }
 
-func Main(ctx context.Context, count int, uri string) error {
-	n := runtime.GOMAXPROCS(0)
-	pool, err := sqlitex.NewPool(uri, sqlitex.PoolOptions{
-		PoolSize: n,
-	})
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command [flags]]\n\n", os.Args[0])
+	fmt.Fprint(out, `Commands:
+  crawl   crawl the registry into the database (default)
+  export  write the refs in the database
+  sample  write a reproducible random sample of the refs in the database
+  diff    compare two databases or two crawl runs
+  runs    list the crawl runs recorded in the database
+  prune   delete or archive tags and repositories that are gone
+  mirror  download images in the database into an OCI image layout
+  submit  submit images in the database to a Clair indexer
+  vulns   fetch Clair vulnerability reports for the submitted images
+  compare compare the vulnerability reports of two runs
+  migrate upgrade the database schema
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// Options is the configuration for a crawl.
+type Options struct {
+	// Count is the number of repositories to page through.
+	Count int
+	// DB is the URI of the database to write to.
+	DB string
+	// MaxAge is how long a repository's tags are considered up to date.
+	// Repositories fetched within this window are skipped.
+	MaxAge time.Duration
+	// Restart ignores any checkpoint left by a previous run.
+	Restart bool
+	// Resolve fetches manifest lists from the registry to record the
+	// per-platform manifests they contain.
+	Resolve bool
+	// Layers fetches image manifests from the registry to record their
+	// config and layers.
+	Layers bool
+	// OSRelease fetches image configs and layers from the registry to record
+	// the distribution each image is built on.
+	OSRelease bool
+	// Attempts is the number of times a request is tried before giving up.
+	Attempts int
+	// Timeout bounds each request attempt.
+	Timeout time.Duration
+	// Auth is used for both the Quay API and the registry.
+	Auth Credentials
+	// Registry is the host of the registry to crawl.
+	Registry string
+	// Lister is the API used to enumerate repositories: "quay" or
+	// "distribution".
+	Lister string
+	// PlainHTTP talks to the registry over HTTP instead of HTTPS.
+	PlainHTTP bool
+	// Query is the search query used by the Quay lister.
+	Query string
+	// Shard splits the Quay search into queries by name prefix. It requires
+	// the default Query.
+	Shard bool
+	// Filter selects the repositories and tags to crawl.
+	Filter Filter
+	// Workers is the number of repositories fetched concurrently. If less
+	// than 1, GOMAXPROCS is used.
+	Workers int
+	// Batch is the number of repositories committed to the database in one
+	// transaction.
+	Batch int
+	// Budget is how many repositories may fail before the crawl gives up.
+	Budget ErrorBudget
+	// RetryFailed fetches only the repositories whose last fetch failed,
+	// instead of paging through the registry.
+	RetryFailed bool
+}
+
+// httpClient returns a client that retries and times out requests according
+// to the options.
+func (opts *Options) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			Attempts: opts.Attempts,
+			Timeout:  opts.Timeout,
+		},
+	}
+}
+
+// registryRoot returns the root URL of the registry "host".
+func (opts *Options) registryRoot(host string) url.URL {
+	root := url.URL{Scheme: "https", Host: host, Path: "/"}
+	if opts.PlainHTTP {
+		root.Scheme = "http"
+	}
+	return root
+}
+
+func Main(ctx context.Context, opts Options) error {
+	hc := opts.httpClient()
+	root := opts.registryRoot(opts.Registry)
+	reg, err := NewRegistry(hc, root.String())
 	if err != nil {
 		return err
 	}
-	defer pool.Close()
-
-	err = func() error {
-		conn, err := pool.Take(ctx)
+	reg.Auth = opts.Auth
+	reg.Blobs = blobClient(opts.Attempts, opts.Timeout)
+	var ls Lister
+	// search is set for the Quay lister, to check afterwards whether it
+	// missed anything.
+	var search *client
+	apiRoot := root.String()
+	switch opts.Lister {
+	case "quay":
+		apiRoot = root.JoinPath("api", "v1").String()
+		search, err = NewClient(hc, apiRoot)
 		if err != nil {
 			return err
 		}
-		defer pool.Put(conn)
-		return sqlitex.ExecuteScriptFS(conn, sql.FS, "init.sql", nil)
-	}()
+		search.Auth = opts.Auth
+		search.Query = opts.Query
+		search.Shard = opts.Shard
+		if opts.Shard && opts.Query != "" && opts.Query != "*" {
+			return fmt.Errorf("-shard can't be used with -query %q", opts.Query)
+		}
+		ls = search
+	case "distribution":
+		if opts.Shard {
+			return errors.New("-shard requires the quay lister")
+		}
+		ls = reg
+	default:
+		return fmt.Errorf("unknown lister: %q", opts.Lister)
+	}
+	switch opts.Filter.ManifestKind {
+	case "", "both", "list", "single":
+	default:
+		return fmt.Errorf("unknown manifest kind: %q", opts.Filter.ManifestKind)
+	}
+
+	// All writes go through this one connection, owned by the writer
+	// goroutine once the crawl starts.
+	conn, err := sqlite.OpenConn(opts.DB, sqlite.OpenReadWrite|sqlite.OpenCreate|sqlite.OpenURI|sqlite.OpenWAL)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	// In WAL mode this only risks the last commits on power loss, which a
+	// re-run picks up again.
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA synchronous = NORMAL;", nil); err != nil {
+		return err
+	}
 
-	c, err := NewClient(new(http.Client), `https://quay.io/api/v1/`)
+	start := 1
+	var regID, runID int64
+	// pass is the run that started this pass through the registry, or 0 if
+	// that isn't known.
+	var pass int64
+	resumed := false
+	var k *known
+	err = func() error {
+		if err := migrate(ctx, conn); err != nil {
+			return err
+		}
+		err = sqlitex.ExecuteFS(conn, sql.FS, "insert_registry.sql", &sqlitex.ExecOptions{
+			Args: []any{opts.Registry},
+		})
+		if err != nil {
+			return err
+		}
+		err = sqlitex.ExecuteFS(conn, sql.FS, "get_registry_id.sql", &sqlitex.ExecOptions{
+			Args: []any{opts.Registry},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				regID = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		k, err = loadKnown(conn, regID)
+		if err != nil {
+			return err
+		}
+		if opts.Restart {
+			err = sqlitex.ExecuteFS(conn, sql.FS, "clear_crawl_state.sql", &sqlitex.ExecOptions{
+				Args: []any{regID, opts.stateKey()},
+			})
+		} else {
+			err = sqlitex.ExecuteFS(conn, sql.FS, "get_crawl_state.sql", &sqlitex.ExecOptions{
+				Args: []any{regID, opts.stateKey()},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					start = stmt.ColumnInt(0)
+					pass = stmt.ColumnInt64(1)
+					resumed = true
+					return nil
+				},
+			})
+		}
+		if err != nil {
+			return err
+		}
+		if opts.RetryFailed {
+			failed, err := loadFailed(conn, regID)
+			if err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "retrying failed repositories", "count", len(failed))
+			ls = &failedLister{Lister: ls, repos: failed}
+			start = 1
+		}
+		runID, err = startRun(conn, regID, apiRoot, &opts)
+		if !resumed {
+			pass = runID
+		}
+		return err
+	}()
 	if err != nil {
 		return err
 	}
+	slog.InfoContext(ctx, "starting crawl run", "run", runID)
+	if start != 1 && !opts.RetryFailed {
+		slog.InfoContext(ctx, "resuming from checkpoint", "page", start)
+	}
 
+	n := opts.Workers
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	parent := ctx
 	eg, ctx := errgroup.WithContext(ctx)
-	repos := make(chan Repo, n)
+	repos := make(chan pagedRepo, n)
+	results := make(chan *repoResult, n)
+	cp := newCheckpoint(start)
+	f := &fetcher{
+		ls:     ls,
+		reg:    reg,
+		known:  k,
+		opts:   &opts,
+		cutoff: time.Now().Add(-opts.MaxAge).Unix(),
+	}
+	if opts.RetryFailed {
+		// Failed repositories are fetched however recently they were last
+		// fetched successfully.
+		f.cutoff = math.MaxInt64
+	}
+	w := &writer{
+		conn:     conn,
+		regID:    regID,
+		runID:    runID,
+		query:    opts.stateKey(),
+		cp:       cp,
+		passRun:  pass,
+		Batch:    max(opts.Batch, 1),
+		Interval: 5 * time.Second,
+		Budget:   opts.Budget,
+
+		SkipCheckpoint: opts.RetryFailed,
+	}
+	exhausted := false
 
 	// Tags fetcher goroutines
+	var fetchers sync.WaitGroup
 	for range n {
+		fetchers.Add(1)
 		eg.Go(func() error {
-			conn, err := pool.Take(ctx)
-			if err != nil {
-				return err
-			}
-			defer pool.Put(conn)
+			defer fetchers.Done()
 			for {
-				var r Repo
+				var pr pagedRepo
 				var ok bool
 				select {
-				case r, ok = <-repos:
+				case pr, ok = <-repos:
 					if !ok {
 						return nil
 					}
 				case <-ctx.Done():
 					return context.Cause(ctx)
 				}
-				l := slog.With(
-					"namespace", r.Namespace,
-					"repository", r.Name,
-				)
-
-				seq, check := c.Tags(ctx, r)
-				tags := slices.Collect(seq)
-				if err := check(); err != nil {
-					return err
-				}
-				if len(tags) == 0 {
-					l.DebugContext(ctx, "no tags found")
-					continue
-				}
-				l.DebugContext(ctx, "got tags", "count", len(tags))
-
-				var err error
-				err = sqlitex.ExecuteFS(conn, sql.FS, "insert_namespace.sql", &sqlitex.ExecOptions{
-					Args: []any{r.Namespace},
-				})
-				if err != nil {
-					return err
-				}
-				err = sqlitex.ExecuteFS(conn, sql.FS, "insert_repository.sql", &sqlitex.ExecOptions{
-					Args: []any{r.Name},
-				})
-				if err != nil {
-					return err
-				}
-
-				for _, tag := range tags {
-					err = sqlitex.ExecuteFS(conn, sql.FS, "insert_tag.sql", &sqlitex.ExecOptions{
-						Args: []any{tag},
-					})
-					if err != nil {
-						return err
-					}
-				}
-
-				// Okay, now build all the rows to insert:
-				todo := make([][]any, 0, len(tags))
-				var nsID, rID int64 = -1, -1
-				err = sqlitex.ExecuteFS(conn, sql.FS, "get_namespace_id.sql", &sqlitex.ExecOptions{
-					Args: []any{r.Namespace},
-					ResultFunc: func(stmt *sqlite.Stmt) (err error) {
-						nsID = stmt.ColumnInt64(0)
-						return err
-					},
-				})
-				if err != nil {
-					slog.ErrorContext(ctx, "query failed", "namespace", r.Namespace)
-					return err
-				}
-				err = sqlitex.ExecuteFS(conn, sql.FS, "get_repository_id.sql", &sqlitex.ExecOptions{
-					Args: []any{r.Name},
-					ResultFunc: func(stmt *sqlite.Stmt) (err error) {
-						rID = stmt.ColumnInt64(0)
-						return err
-					},
-				})
-				if err != nil {
-					slog.ErrorContext(ctx, "query failed", "repository", r.Name)
-					return err
-				}
-				for _, t := range tags {
-					err = sqlitex.ExecuteFS(conn, sql.FS, "get_tag_id.sql", &sqlitex.ExecOptions{
-						Args: []any{t},
-						ResultFunc: func(stmt *sqlite.Stmt) error {
-							tID := stmt.ColumnInt64(0)
-							todo = append(todo, []any{nsID, rID, tID})
-							return nil
-						},
-					})
-					if err != nil {
-						return err
-					}
+				res, err := f.Fetch(ctx, pr)
+				switch {
+				case err == nil:
+				case ctx.Err() != nil:
+					return context.Cause(ctx)
+				default:
+					// A single repository failing doesn't end the crawl;
+					// the writer records it and enforces the budget.
+					slog.WarnContext(ctx, "fetching repository failed",
+						"namespace", pr.Namespace,
+						"repository", pr.Name,
+						"reason", err)
+					res = &repoResult{pagedRepo: pr, Err: err}
 				}
-
-				for _, args := range todo {
-					err = sqlitex.ExecuteFS(conn, sql.FS, "insert_repo.sql", &sqlitex.ExecOptions{
-						Args: args,
-					})
-					if err != nil {
-						return err
-					}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return context.Cause(ctx)
 				}
-				l.DebugContext(ctx, "inserted repos", "count", len(todo))
 			}
 		})
 	}
+	eg.Go(func() error {
+		fetchers.Wait()
+		close(results)
+		return nil
+	})
+
+	// Writer goroutine
+	eg.Go(func() error {
+		return w.Run(ctx, results)
+	})
 
 	// Repo fetcher goroutine
 	eg.Go(func() error {
@@ -242,239 +491,142 @@ func Main(ctx context.Context, count int, uri string) error {
 		n := 0
 
 		defer func() {
-			slog.InfoContext(ctx, "done paging repositories", "count", n, "limit", count)
+			slog.InfoContext(ctx, "done paging repositories", "count", n, "limit", opts.Count)
 		}()
-		slog.InfoContext(ctx, "start paging repositories", "count", n, "limit", count)
+		slog.InfoContext(ctx, "start paging repositories", "count", n, "limit", opts.Count, "page", start)
 
 		var err error
-		seq, check := c.Repositories(ctx)
+		limited := false
+		seq, check := ls.Repositories(ctx, start)
 	Seq:
-		for r := range seq {
+		for pr := range seq {
+			if !opts.Filter.Repo(pr.Repo) {
+				slog.DebugContext(ctx, "filtered repo", "namespace", pr.Namespace, "repository", pr.Name)
+				continue
+			}
+			cp.Add(pr.Page)
 			select {
-			case repos <- r:
+			case repos <- pr:
 			case <-ctx.Done():
 				err = context.Cause(ctx)
 				break Seq
 			}
 			n++
 			switch {
-			case n%10 == 0:
-				slog.DebugContext(ctx, "fetched repos", "count", n, "limit", count)
-			case n >= count:
+			case n >= opts.Count:
+				limited = true
 				break Seq
+			case n%10 == 0:
+				slog.DebugContext(ctx, "fetched repos", "count", n, "limit", opts.Count)
 			}
 		}
 
 		if err := errors.Join(err, check()); err != nil {
 			return err
 		}
+		exhausted = !limited
 
 		return nil
 	})
 
 	// curl -H 'Accept: application/json' -H 'Content-Type: application/json' -H "Authorization: Bearer ${quay_token}" 'https://quay.io/api/v1/find/repositories?includeUsage=false&page_size=15&query=*&page=1' | jq '.results |= map_values(.href)'
-	return eg.Wait()
-}
-
-type Repo struct {
-	Namespace string
-	Name      string
-}
-
-type client struct {
-	c     *http.Client
-	root  *url.URL
-	Token string
-}
-
-func NewClient(c *http.Client, root string) (*client, error) {
-	if !strings.HasSuffix("root", "/") {
-		root += "/"
+	err = eg.Wait()
+	if err == nil && exhausted && !opts.RetryFailed {
+		// Every page was walked, so the next run should start over.
+		slog.DebugContext(ctx, "crawl complete, clearing checkpoint")
+		err = sqlitex.ExecuteFS(conn, sql.FS, "clear_crawl_state.sql", &sqlitex.ExecOptions{
+			Args: []any{regID, opts.stateKey()},
+		})
+		switch {
+		case err != nil || pass == 0 || !opts.fullScope():
+		case search != nil && search.Truncated():
+			slog.WarnContext(ctx, "search results were cut off, not marking anything gone")
+		default:
+			slog.InfoContext(ctx, "marking unseen tags and repositories gone", "pass", pass)
+			err = markGone(conn, regID, pass)
+		}
 	}
-	u, err := url.Parse(root)
-	if err != nil {
-		return nil, err
+	// Only a run that walked every page from the first saw everything a diff
+	// would expect it to.
+	complete := err == nil && exhausted && start == 1 && !opts.RetryFailed
+	if ferr := finishRun(parent, conn, runID, w.committed-w.failed, w.failed, complete, err); ferr != nil {
+		err = errors.Join(err, ferr)
 	}
-	return &client{
-		c:    c,
-		root: u,
-	}, nil
+	return err
 }
 
-func (c *client) Repositories(ctx context.Context) (iter.Seq[Repo], func() error) {
-	var errReturn error
-	errFunc := func() error { return errReturn }
-	seq := func(yield func(Repo) bool) {
-		const maxPage = 100
-		page := 1
-		var buf bytes.Buffer
-		buf.Grow(1 << 20)
-		dup := make(map[uint64]struct{})
-		seed := maphash.MakeSeed()
-
-		endpt := c.root.JoinPath("find", "repositories")
-		for {
-			u := *endpt
-			v := u.Query()
-			v.Set("includeUsage", "false")
-			v.Set("query", "*")
-			v.Set("page", strconv.Itoa(page))
-			u.RawQuery = v.Encode()
-
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-			if err != nil {
-				errReturn = err
-				return
-			}
-			req.Header.Set(`Accept`, `application/json`)
-			if c.Token != "" {
-				req.Header.Set(`Authorization`, `Bearer `+c.Token)
-			}
-
-			slog.DebugContext(ctx, "making request", "page", page, "url", u.String())
-			res, err := c.c.Do(req)
-			if err != nil {
-				errReturn = err
-				return
-			}
-			if res.StatusCode != http.StatusOK {
-				res.Body.Close()
-				errReturn = fmt.Errorf("unexpected response: %s", res.Status)
-				return
-			}
-			buf.Reset()
-			_, err = io.Copy(&buf, res.Body)
-			if err := errors.Join(err, res.Body.Close()); err != nil {
-				errReturn = err
-				return
-			}
-
-			var findres FindRepositoriesResult
-			if err := json.Unmarshal(buf.Bytes(), &findres); err != nil {
-				errReturn = err
-				return
-			}
-
-			// The Quay API is really odd here and will just return page 10
-			// forever, so stop walking if this isn't the page requested.
-			if page != findres.Page {
-				break
-			}
-
-			for _, r := range findres.Results {
-				id := maphash.String(seed, r.Href)
-				_, ok := dup[id]
-				if !ok {
-					dup[id] = struct{}{}
-					out := Repo{
-						Namespace: r.Namespace.Name,
-						Name:      r.Name,
-					}
-					if !yield(out) {
-						return
-					}
-				} else {
-					slog.DebugContext(ctx, "skip repo", "page", findres.Page, "additional", findres.Additional, "href", r.Href)
-				}
-			}
-
-			page++
-			// In case the Quay API starts being normal:
-			if page >= maxPage || !findres.Additional {
-				break
-			}
-		}
+// fullScope reports whether a crawl with these options covers every repository
+// and tag in the registry, so that anything it didn't see is gone.
+func (opts *Options) fullScope() bool {
+	if !opts.Filter.Empty() {
+		return false
 	}
-
-	return seq, errFunc
+	return opts.Lister != "quay" || opts.Query == "" || opts.Query == "*"
 }
 
-type FindRepositoriesResult struct {
-	Results []struct {
-		Name      string `json:"name"`
-		Namespace struct {
-			Name string `json:"name"`
-		} `json:"namespace"`
-		Href string `json:"href"`
-	} `json:"results"`
-	Additional bool `json:"has_additional"`
-	Page       int  `json:"page"`
+// stateKey is the query the crawl's checkpoint is saved under. Sharded crawls
+// number their pages differently, so their checkpoints are kept apart.
+func (opts *Options) stateKey() string {
+	if opts.Shard {
+		return "shard:" + opts.Query
+	}
+	return opts.Query
 }
 
-func (c *client) Tags(ctx context.Context, repo Repo) (iter.Seq[string], func() error) {
-	var errReturn error
-	errFunc := func() error { return errReturn }
-	seq := func(yield func(string) bool) {
-		page := 1
-		additional := true
-		var buf bytes.Buffer
-		buf.Grow(1 << 20)
-
-		endpt := c.root.JoinPath("repository", repo.Namespace, repo.Name, "tag", "")
-		for additional {
-			u := *endpt
-			v := u.Query()
-			v.Set("page", strconv.Itoa(page))
-			v.Set("limit", "100")
-			v.Set("onlyActiveTags", "true")
-			u.RawQuery = v.Encode()
-
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-			if err != nil {
-				errReturn = err
-				return
-			}
-			req.Header.Set(`Accept`, `application/json`)
-			if c.Token != "" {
-				req.Header.Set(`Authorization`, `Bearer `+c.Token)
-			}
-
-			res, err := c.c.Do(req)
-			if err != nil {
-				errReturn = err
-				return
-			}
-			if res.StatusCode != http.StatusOK {
-				res.Body.Close()
-				errReturn = fmt.Errorf("unexpected response: %s", res.Status)
-				return
-			}
-			buf.Reset()
-			_, err = io.Copy(&buf, res.Body)
-			if err := errors.Join(err, res.Body.Close()); err != nil {
-				errReturn = err
-				return
-			}
-
-			var tagsres ListTagsResult
-			if err := json.Unmarshal(buf.Bytes(), &tagsres); err != nil {
-				errReturn = err
-				return
-			}
+// pagedRepo is a [Repo] along with the search page it was found on.
+type pagedRepo struct {
+	Repo
+	Page int
+	// Meta is what the lister knows about the repository, or nil.
+	Meta *RepoMeta
+}
 
-			for _, t := range tagsres.Tags {
-				if !t.IsList {
-					continue
-				}
-				if !yield(t.Name) {
-					return
-				}
-			}
+type Repo struct {
+	Namespace string
+	Name      string
+}
 
-			additional = tagsres.Additional
-			page++
-		}
-	}
+// RepoMeta is the metadata about a repository that only the Quay API
+// provides.
+type RepoMeta struct {
+	Description string `json:"description,omitempty"`
+	Public      bool   `json:"public"`
+	// Kind is "repository" or "application".
+	Kind       string  `json:"kind,omitempty"`
+	Popularity float64 `json:"popularity,omitempty"`
+	// LastModified is when the repository was last pushed to.
+	LastModified time.Time `json:"last_modified,omitzero"`
+	// NamespaceKind is "user" or "organization".
+	NamespaceKind string `json:"namespace_kind,omitempty"`
+}
 
-	return seq, errFunc
+// Tag is a tag in a repository and the manifest it points to.
+type Tag struct {
+	Name   string
+	Digest string
+	// IsList reports whether the manifest is a manifest list (or OCI index)
+	// rather than a single image manifest.
+	IsList bool
+
+	// The rest is metadata only the Quay API provides. It's left as the zero
+	// value when unknown.
+
+	// Started is when the tag started pointing at the manifest.
+	Started time.Time
+	// LastModified is when the tag was last changed.
+	LastModified time.Time
+	// Size is the size of the image in bytes, as reported by Quay.
+	Size int64
+	// Expiration is when the tag is set to expire.
+	Expiration time.Time
 }
 
-type ListTagsResult struct {
-	Tags []struct {
-		Name   string `json:"name"`
-		Digest string `json:"manifest_digest"`
-		IsList bool   `json:"is_manifest_list"`
-	} `json:"tags"`
-	Additional bool `json:"has_additional"`
-	Page       int  `json:"page"`
+// Lister enumerates the repositories and tags in a registry.
+type Lister interface {
+	// Repositories yields repositories, starting at page "start", along with
+	// the page each was found on. What a "page" is depends on the
+	// implementation, but pages must be stable enough to resume from.
+	Repositories(ctx context.Context, start int) (iter.Seq[pagedRepo], func() error)
+	// Tags yields all the tags in the repository "repo".
+	Tags(ctx context.Context, repo Repo) (iter.Seq[Tag], func() error)
 }
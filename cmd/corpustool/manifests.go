@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// fetchLists fetches the index for every manifest list in "tags" that has not
+// been resolved yet. On error, the indexes fetched so far are returned along
+// with it.
+func fetchLists(ctx context.Context, reg *registry, k *known, r Repo, tags []Tag) ([]fetchedIndex, error) {
+	name := path.Join(r.Namespace, r.Name)
+	var out []fetchedIndex
+	for _, t := range tags {
+		if !t.IsList || !k.ClaimList(t.Digest) {
+			continue
+		}
+
+		idx, err := reg.Index(ctx, name, t.Digest)
+		if err != nil {
+			k.ReleaseList(t.Digest)
+			return out, err
+		}
+		var cs []string
+		for _, d := range idx.Manifests {
+			if !isListType(d.MediaType) {
+				cs = append(cs, d.Digest)
+			}
+		}
+		k.SetChildren(t.Digest, cs)
+		out = append(out, fetchedIndex{Digest: t.Digest, Index: idx})
+		slog.DebugContext(ctx, "resolved manifest list",
+			"repository", name,
+			"digest", t.Digest,
+			"count", len(idx.Manifests))
+	}
+	return out, nil
+}
+
+// fetchLayers fetches the image manifest for every single-platform manifest
+// referenced by "tags", either directly or as the child of a resolved
+// manifest list, whose layers have not been recorded yet. On error, the
+// manifests fetched so far are returned along with it.
+func fetchLayers(ctx context.Context, reg *registry, k *known, r Repo, tags []Tag) ([]fetchedManifest, error) {
+	name := path.Join(r.Namespace, r.Name)
+	var out []fetchedManifest
+	for _, d := range imageManifests(k, tags) {
+		if !k.ClaimManifest(d) {
+			continue
+		}
+		m, err := reg.ImageManifest(ctx, name, d)
+		if err != nil {
+			k.ReleaseManifest(d)
+			return out, err
+		}
+		out = append(out, fetchedManifest{Digest: d, Manifest: m})
+		slog.DebugContext(ctx, "fetched image manifest",
+			"repository", name,
+			"digest", d,
+			"count", len(m.Layers))
+	}
+	return out, nil
+}
+
+// imageManifests returns the digests of the single-platform manifests
+// referenced by "tags", either directly or as the children of resolved
+// manifest lists.
+func imageManifests(k *known, tags []Tag) []string {
+	var out []string
+	for _, t := range tags {
+		if !t.IsList {
+			out = append(out, t.Digest)
+			continue
+		}
+		out = append(out, k.Children(t.Digest)...)
+	}
+	return out
+}
+
+// insertIndex records the child manifests of the manifest list "digest" and
+// their platforms.
+func insertIndex(conn *sqlite.Conn, digest string, idx *Index) error {
+	for _, d := range idx.Manifests {
+		var p Platform
+		if d.Platform != nil {
+			p = *d.Platform
+		}
+		err := sqlitex.ExecuteFS(conn, sql.FS, "insert_manifest.sql", &sqlitex.ExecOptions{
+			Args: []any{d.Digest, isListType(d.MediaType)},
+		})
+		if err != nil {
+			return err
+		}
+		err = sqlitex.ExecuteFS(conn, sql.FS, "insert_manifest_child.sql", &sqlitex.ExecOptions{
+			Args: []any{digest, d.Digest, p.OS, p.Architecture, p.Variant},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertLayers records the config and layers of the manifest "m", whose digest
+// is "digest".
+func insertLayers(conn *sqlite.Conn, digest string, m *Manifest) error {
+	// The manifest may be the child of a list resolved by another fetcher,
+	// whose result hasn't been written yet.
+	err := sqlitex.ExecuteFS(conn, sql.FS, "insert_manifest.sql", &sqlitex.ExecOptions{
+		Args: []any{digest, false},
+	})
+	if err != nil {
+		return err
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "set_manifest_config.sql", &sqlitex.ExecOptions{
+		Args: []any{m.Config.Digest, digest},
+	})
+	if err != nil {
+		return err
+	}
+	for i, l := range m.Layers {
+		err = sqlitex.ExecuteFS(conn, sql.FS, "insert_layer.sql", &sqlitex.ExecOptions{
+			Args: []any{l.Digest, l.Size},
+		})
+		if err != nil {
+			return err
+		}
+		err = sqlitex.ExecuteFS(conn, sql.FS, "insert_manifest_layer.sql", &sqlitex.ExecOptions{
+			Args: []any{digest, i, l.Digest, l.MediaType},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
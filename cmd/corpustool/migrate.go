@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// migrations returns the paths of the schema migrations, in order.
+//
+// The schema version of a database (its "user_version") is the number of
+// migrations that have been applied to it.
+func migrations() ([]string, error) {
+	return fs.Glob(sql.FS, "migrations/*.sql")
+}
+
+// schemaVersion reports the schema version of the database on "conn".
+func schemaVersion(conn *sqlite.Conn) (v int, err error) {
+	err = sqlitex.ExecuteTransient(conn, "PRAGMA user_version;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			v = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	return v, err
+}
+
+// migrate applies any outstanding migrations to the database on "conn" in a
+// single transaction.
+//
+// It refuses to touch a database with a schema newer than this binary knows
+// about.
+func migrate(ctx context.Context, conn *sqlite.Conn) (err error) {
+	ms, err := migrations()
+	if err != nil {
+		return err
+	}
+	defer sqlitex.Save(conn)(&err)
+	v, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v > len(ms):
+		return fmt.Errorf("database schema version %d is newer than supported version %d", v, len(ms))
+	case v == len(ms):
+		return nil
+	}
+	for _, m := range ms[v:] {
+		slog.InfoContext(ctx, "applying migration", "name", m)
+		if err := sqlitex.ExecuteScriptFS(conn, sql.FS, m, nil); err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+	}
+	// Pragmas can't take parameters, but this is an integer.
+	return sqlitex.ExecuteTransient(conn, fmt.Sprintf("PRAGMA user_version = %d;", len(ms)), nil)
+}
+
+// openReadOnly opens the database "uri" for reading, checking that its schema
+// is the one this binary expects.
+func openReadOnly(ctx context.Context, uri string) (*sqlite.Conn, error) {
+	conn, err := sqlite.OpenConn(uri, sqlite.OpenReadOnly|sqlite.OpenURI)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetInterrupt(ctx.Done())
+	ms, err := migrations()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	v, err := schemaVersion(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if v != len(ms) {
+		conn.Close()
+		return nil, fmt.Errorf("%s: database schema version %d, expected %d (run the \"migrate\" command to upgrade)", uri, v, len(ms))
+	}
+	return conn, nil
+}
+
+// migrateMain opens the database "db" and brings its schema up to date.
+func migrateMain(ctx context.Context, db string) error {
+	conn, err := sqlite.OpenConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+	return migrate(ctx, conn)
+}
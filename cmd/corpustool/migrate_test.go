@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	ms, err := migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Fresh", func(t *testing.T) {
+		conn := openTestDB(t)
+		if err := migrate(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+		v, err := schemaVersion(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := v, len(ms); got != want {
+			t.Errorf("version: got: %d, want: %d", got, want)
+		}
+		// Running again is a no-op.
+		if err := migrate(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Original", func(t *testing.T) {
+		// A database written by the original, unversioned schema.
+		conn := openTestDB(t)
+		err := sqlitex.ExecuteScriptFS(conn, sql.FS, ms[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sqlitex.ExecuteScript(conn, `
+INSERT INTO namespace_name (value) VALUES ('ns');
+INSERT INTO repository_name (value) VALUES ('repo');
+INSERT INTO tag_name (value) VALUES ('latest');
+INSERT INTO repo_tag (namespace, repository, tag) VALUES (1, 1, 1);
+`, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := migrate(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+		var refs []string
+		err = sqlitex.ExecuteTransient(conn, `SELECT ref FROM refs;`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				refs = append(refs, stmt.ColumnText(0))
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Join(refs, ","), "quay.io/ns/repo:latest"; got != want {
+			t.Errorf("refs: got: %q, want: %q", got, want)
+		}
+	})
+
+	t.Run("Newer", func(t *testing.T) {
+		conn := openTestDB(t)
+		if err := sqlitex.ExecuteTransient(conn, "PRAGMA user_version = 1000;", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := migrate(ctx, conn); err == nil {
+			t.Error("expected error migrating a newer database")
+		}
+	})
+}
+
+func openTestDB(t *testing.T) *sqlite.Conn {
+	t.Helper()
+	conn, err := sqlite.OpenConn(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := conn.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return conn
+}
+
+func TestOpenReadOnlyURI(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "test.db")
+	conn, err := sqlite.OpenConn(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := migrate(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := openReadOnly(ctx, "file:"+name+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := sqlitex.ExecuteTransient(ro, `CREATE TABLE t (x);`, nil); err == nil {
+		t.Error("wrote to a read-only database")
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Annotation keys used in the index of an image layout.
+const annotationRefName = `org.opencontainers.image.ref.name`
+
+// MirrorOptions is the configuration for the "mirror" subcommand.
+type MirrorOptions struct {
+	// Dir is the image layout directory, created if needed.
+	Dir string
+	// Refs, if not empty, is a file of references to mirror, one per line,
+	// as written by "export" or "sample". "-" is stdin. Otherwise, the refs
+	// in the database are mirrored.
+	Refs string
+	// Registry and Filter select refs from the database, as for
+	// [ExportOptions].
+	Registry string
+	Filter   Filter
+	// Limit, if positive, is the maximum number of refs to mirror.
+	Limit int
+	// Platform, if set, mirrors only the manifest for this platform out of
+	// manifest lists, and records it in the index instead of the list.
+	Platform *Platform
+	// Workers is the number of refs mirrored concurrently.
+	Workers int
+}
+
+// mirrorMain parses the "mirror" subcommand's flags from "args" and runs it.
+// The registry connection settings are taken from "global".
+func mirrorMain(ctx context.Context, global *Options, args []string) error {
+	opts := MirrorOptions{Workers: 4}
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mirror [flags] DIR\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Refs, "refs", "", "mirror the references in `file` (\"-\" for stdin) instead of the database")
+	fs.StringVar(&opts.Registry, "registry", "", "only mirror refs from registry `host`")
+	fs.Var((*listFlag)(&opts.Filter.Namespaces), "namespace", "only mirror these namespaces (comma-separated, repeatable)")
+	fs.Var((*listFlag)(&opts.Filter.ExcludeNamespaces), "exclude-namespace", "skip these namespaces (comma-separated, repeatable)")
+	fs.Func("repository", "only mirror repositories whose \"namespace/name\" matches `regexp`", regexpFlag(&opts.Filter.Repository))
+	fs.Func("tag", "only mirror tags matching `regexp`", regexpFlag(&opts.Filter.Tag))
+	fs.Var((*listFlag)(&opts.Filter.Distros), "distro", "only mirror images of these distributions, as `id[:version]` (comma-separated, repeatable)")
+	fs.IntVar(&opts.Limit, "limit", 0, "mirror at most `N` refs")
+	fs.Func("platform", "only mirror the `os/arch[/variant]` manifest out of manifest lists", func(v string) error {
+		p, err := parsePlatform(v)
+		opts.Platform = p
+		return err
+	})
+	fs.IntVar(&opts.Workers, "workers", opts.Workers, "number of refs to mirror concurrently")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("mirror needs a directory")
+	}
+	opts.Dir = fs.Arg(0)
+
+	var refs []Ref
+	var err error
+	if opts.Refs != "" {
+		refs, err = readRefs(opts.Refs)
+	} else {
+		refs, err = selectRefs(ctx, global.DB, &opts)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Limit > 0 && len(refs) > opts.Limit {
+		refs = refs[:opts.Limit]
+	}
+	return Mirror(ctx, global, refs, opts)
+}
+
+// selectRefs reads the refs in the database "db" selected by "opts".
+func selectRefs(ctx context.Context, db string, opts *MirrorOptions) ([]Ref, error) {
+	conn, err := openReadOnly(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		return nil, err
+	}
+	return filterRefs(refs, opts.Registry, &opts.Filter), nil
+}
+
+// readRefs reads references, one per line, from the file "name", or stdin if
+// "name" is "-". Blank lines are skipped.
+func readRefs(name string) ([]Ref, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var out []Ref
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" {
+			continue
+		}
+		ref, err := parseRef(l)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ref)
+	}
+	return out, s.Err()
+}
+
+// parseRef parses a reference by tag or by digest, as written by
+// [Ref.TagRef] and [Ref.DigestRef].
+func parseRef(s string) (Ref, error) {
+	var ref Ref
+	host, rest, ok := strings.Cut(s, "/")
+	if !ok {
+		return ref, fmt.Errorf("bad reference: %q", s)
+	}
+	ref.Registry = host
+	if name, d, ok := strings.Cut(rest, "@"); ok {
+		rest, ref.Digest = name, d
+	} else if i := strings.LastIndexByte(rest, ':'); i > strings.LastIndexByte(rest, '/') {
+		rest, ref.Tag = rest[:i], rest[i+1:]
+	}
+	if rest == "" || (ref.Tag == "" && ref.Digest == "") {
+		return ref, fmt.Errorf("bad reference: %q", s)
+	}
+	r := splitName(rest)
+	ref.Namespace, ref.Repository = r.Namespace, r.Name
+	return ref, nil
+}
+
+// parsePlatform parses a platform written as "os/arch[/variant]".
+func parsePlatform(s string) (*Platform, error) {
+	f := strings.Split(s, "/")
+	if len(f) < 2 || len(f) > 3 || f[0] == "" || f[1] == "" {
+		return nil, fmt.Errorf("bad platform: %q", s)
+	}
+	p := &Platform{OS: f[0], Architecture: f[1]}
+	if len(f) == 3 {
+		p.Variant = f[2]
+	}
+	return p, nil
+}
+
+// Mirror downloads "refs" into the image layout described by "opts", using
+// the registry connection settings from "global". A ref that fails is
+// logged and skipped, and reported in the returned error.
+func Mirror(ctx context.Context, global *Options, refs []Ref, opts MirrorOptions) error {
+	l, err := openLayout(opts.Dir)
+	if err != nil {
+		return err
+	}
+	m := &mirrorer{
+		regs:     newRegistries(global),
+		layout:   l,
+		platform: opts.Platform,
+	}
+
+	var mu sync.Mutex
+	var entries []Descriptor
+	var failed int
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(opts.Workers, 1))
+	for _, ref := range refs {
+		eg.Go(func() error {
+			ds, err := m.mirrorRef(ctx, &ref)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+			case ctx.Err() != nil:
+				return context.Cause(ctx)
+			default:
+				slog.WarnContext(ctx, "mirroring failed", "ref", ref.DigestRef(), "reason", err)
+				failed++
+				return nil
+			}
+			entries = append(entries, ds...)
+			return nil
+		})
+	}
+	err = eg.Wait()
+	// Record whatever finished, even if interrupted.
+	if ierr := l.addIndex(entries); ierr != nil {
+		err = errors.Join(err, ierr)
+	}
+	slog.InfoContext(ctx, "mirrored",
+		"refs", len(refs)-failed,
+		"failed", failed,
+		"blobs", m.blobs.Load(),
+		"bytes", m.bytes.Load())
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d refs failed", failed, len(refs))
+	}
+	return err
+}
+
+// mirrorer copies images from registries into a layout.
+type mirrorer struct {
+	regs     *registries
+	layout   *layout
+	platform *Platform
+
+	// blobs and bytes count what was downloaded.
+	blobs, bytes atomic.Int64
+}
+
+// registries hands out a client per registry host, for commands that work on
+// refs from more than one registry. Only the registry named by the global
+// options is given credentials.
+type registries struct {
+	global *Options
+
+	mu   sync.Mutex
+	regs map[string]*registry
+}
+
+func newRegistries(global *Options) *registries {
+	return &registries{global: global, regs: make(map[string]*registry)}
+}
+
+// Get returns the client for the registry "host".
+func (rs *registries) Get(host string) (*registry, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if reg, ok := rs.regs[host]; ok {
+		return reg, nil
+	}
+	root := rs.global.registryRoot(host)
+	reg, err := NewRegistry(rs.global.httpClient(), root.String())
+	if err != nil {
+		return nil, err
+	}
+	reg.Blobs = blobClient(rs.global.Attempts, rs.global.Timeout)
+	if host == rs.global.Registry {
+		reg.Auth = rs.global.Auth
+	}
+	rs.regs[host] = reg
+	return reg, nil
+}
+
+// mirrorRef mirrors the image "ref" and returns the descriptors to record for
+// it in the index.
+func (m *mirrorer) mirrorRef(ctx context.Context, ref *Ref) ([]Descriptor, error) {
+	reg, err := m.regs.Get(ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(ref.Namespace, ref.Repository)
+	target := cmp.Or(ref.Digest, ref.Tag)
+	b, desc, err := m.manifest(ctx, reg, name, target)
+	if err != nil {
+		return nil, err
+	}
+	annotate := func(d Descriptor) Descriptor {
+		d.Annotations = map[string]string{annotationRefName: ref.TagRef()}
+		if ref.Tag == "" {
+			d.Annotations[annotationRefName] = ref.DigestRef()
+		}
+		return d
+	}
+	if !isListType(desc.MediaType) {
+		if err := m.mirrorImage(ctx, reg, name, b, desc); err != nil {
+			return nil, err
+		}
+		return []Descriptor{annotate(desc)}, nil
+	}
+
+	var idx Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	var out []Descriptor
+	for _, c := range idx.Manifests {
+		if isListType(c.MediaType) || (m.platform != nil && !matchPlatform(m.platform, c.Platform)) {
+			continue
+		}
+		cb, cd, err := m.manifest(ctx, reg, name, c.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.mirrorImage(ctx, reg, name, cb, cd); err != nil {
+			return nil, err
+		}
+		cd.Platform = c.Platform
+		out = append(out, annotate(cd))
+	}
+	if m.platform != nil {
+		if len(out) == 0 {
+			return nil, fmt.Errorf("no manifest for platform %s/%s", m.platform.OS, m.platform.Architecture)
+		}
+		return out, nil
+	}
+	if err := m.layout.put(desc.Digest, b); err != nil {
+		return nil, err
+	}
+	return []Descriptor{annotate(desc)}, nil
+}
+
+// manifest returns the manifest "target" in the repository "name", from the
+// layout if it's already there, and its descriptor. A manifest fetched by
+// digest is verified.
+func (m *mirrorer) manifest(ctx context.Context, reg *registry, name, target string) ([]byte, Descriptor, error) {
+	var d Descriptor
+	b, err := m.layout.get(target)
+	if err != nil {
+		b, d.MediaType, err = reg.Manifest(ctx, name, target)
+		if err != nil {
+			return nil, d, err
+		}
+	}
+	sum := sha256.Sum256(b)
+	d.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	d.Size = int64(len(b))
+	if strings.HasPrefix(target, "sha256:") && d.Digest != target {
+		return nil, d, fmt.Errorf("%s@%s: digest mismatch: got %s", name, target, d.Digest)
+	}
+	var v struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, d, err
+	}
+	switch {
+	case v.MediaType != "":
+		d.MediaType = v.MediaType
+	case d.MediaType != "":
+	case v.Manifests != nil:
+		d.MediaType = mediaTypeOCIIndex
+	default:
+		d.MediaType = mediaTypeOCIManifest
+	}
+	return b, d, nil
+}
+
+// mirrorImage mirrors the config and layers of the image manifest "b", then
+// the manifest itself, so that a manifest in the layout means the whole image
+// is there.
+func (m *mirrorer) mirrorImage(ctx context.Context, reg *registry, name string, b []byte, desc Descriptor) error {
+	if m.layout.has(desc.Digest) {
+		return nil
+	}
+	var man Manifest
+	if err := json.Unmarshal(b, &man); err != nil {
+		return err
+	}
+	for _, d := range append([]Descriptor{man.Config}, man.Layers...) {
+		n, err := m.layout.fetch(ctx, reg, name, d)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			m.blobs.Add(1)
+			m.bytes.Add(n)
+		}
+	}
+	return m.layout.put(desc.Digest, b)
+}
+
+// matchPlatform reports whether "p" is the platform "want".
+func matchPlatform(want, p *Platform) bool {
+	return p != nil && p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+// layout is an OCI image layout directory.
+//
+// Blobs are written under a temporary name and renamed into place once their
+// digest is verified, so a blob in the layout is always complete. Partial
+// downloads are kept for the next attempt to resume.
+type layout struct {
+	dir string
+
+	mu sync.Mutex
+	// busy holds a channel for each blob being written, closed when it's
+	// done.
+	busy map[string]chan struct{}
+}
+
+// openLayout creates the image layout "dir" if needed.
+func openLayout(dir string) (*layout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, "oci-layout")
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(p, []byte(`{"imageLayoutVersion": "1.0.0"}`+"\n"), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return &layout{dir: dir, busy: make(map[string]chan struct{})}, nil
+}
+
+// blobPath returns the path of the blob "d", which must be a sha256 digest.
+func (l *layout) blobPath(d string) (string, error) {
+	h, ok := strings.CutPrefix(d, "sha256:")
+	if _, err := hex.DecodeString(h); !ok || len(h) != 64 || err != nil {
+		return "", fmt.Errorf("unsupported digest: %q", d)
+	}
+	return filepath.Join(l.dir, "blobs", "sha256", h), nil
+}
+
+// lock waits until no one else is writing the blob "d", and returns the
+// function that lets the next writer in.
+func (l *layout) lock(d string) func() {
+	for {
+		l.mu.Lock()
+		ch, ok := l.busy[d]
+		if !ok {
+			l.busy[d] = make(chan struct{})
+			l.mu.Unlock()
+			return func() {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				close(l.busy[d])
+				delete(l.busy, d)
+			}
+		}
+		l.mu.Unlock()
+		<-ch
+	}
+}
+
+// has reports whether the blob "d" is in the layout.
+func (l *layout) has(d string) bool {
+	p, err := l.blobPath(d)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// get reads the blob "d" out of the layout.
+func (l *layout) get(d string) ([]byte, error) {
+	p, err := l.blobPath(d)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// put writes "b" as the blob "d", after checking its digest.
+func (l *layout) put(d string, b []byte) error {
+	p, err := l.blobPath(d)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	if got := "sha256:" + hex.EncodeToString(sum[:]); got != d {
+		return fmt.Errorf("%s: digest mismatch: got %s", d, got)
+	}
+	defer l.lock(d)()
+	if l.has(d) {
+		return nil
+	}
+	tmp := p + ".partial"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// fetch downloads the blob "desc" from the repository "name" into the layout,
+// resuming a partial download if there is one, and reports how many bytes
+// were downloaded. Nothing is downloaded if the blob is already there.
+func (l *layout) fetch(ctx context.Context, reg *registry, name string, desc Descriptor) (n int64, err error) {
+	p, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	defer l.lock(desc.Digest)()
+	if l.has(desc.Digest) {
+		return 0, nil
+	}
+
+	tmp := p + ".partial"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if f != nil {
+			err = errors.Join(err, f.Close())
+		}
+	}()
+	h := sha256.New()
+	off, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	if desc.Size > 0 && off > desc.Size {
+		off = 0
+	}
+	if off < desc.Size || desc.Size <= 0 {
+		rc, resumed, err := reg.BlobFrom(ctx, name, desc.Digest, off)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		if !resumed && off > 0 {
+			off = 0
+		}
+		if off == 0 {
+			h.Reset()
+			if err := f.Truncate(0); err != nil {
+				return 0, err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+		if off > 0 {
+			slog.DebugContext(ctx, "resuming download", "digest", desc.Digest, "offset", off)
+		}
+		n, err = io.Copy(io.MultiWriter(f, h), rc)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != desc.Digest {
+		f.Close()
+		f = nil
+		return n, errors.Join(
+			fmt.Errorf("%s@%s: digest mismatch: got %s", name, desc.Digest, got),
+			os.Remove(tmp))
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, p)
+}
+
+// addIndex adds "ds" to the layout's index.json, replacing any entries with
+// the same reference name.
+func (l *layout) addIndex(ds []Descriptor) error {
+	p := filepath.Join(l.dir, "index.json")
+	idx := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []Descriptor `json:"manifests"`
+	}{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []Descriptor{}}
+	b, err := os.ReadFile(p)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return err
+	}
+
+	refName := func(d Descriptor) string { return d.Annotations[annotationRefName] }
+	added := make(map[string]bool, len(ds))
+	for _, d := range ds {
+		added[refName(d)] = true
+	}
+	idx.Manifests = slices.DeleteFunc(idx.Manifests, func(d Descriptor) bool {
+		return added[refName(d)]
+	})
+	idx.Manifests = append(idx.Manifests, ds...)
+	slices.SortStableFunc(idx.Manifests, func(a, b Descriptor) int {
+		return cmp.Compare(refName(a), refName(b))
+	})
+
+	b, err = json.MarshalIndent(&idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
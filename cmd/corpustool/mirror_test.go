@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRegistry serves blobs and manifests by digest, and manifests by tag,
+// counting the requests for each path.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	blobs    map[string][]byte
+	tags     map[string]string
+	requests map[string]int
+	ranges   int
+	// stall, if set, is how long whole blobs stop halfway through.
+	stall time.Duration
+}
+
+func (f *fakeRegistry) add(b []byte) string {
+	sum := sha256.Sum256(b)
+	d := "sha256:" + hex.EncodeToString(sum[:])
+	f.blobs[d] = b
+	return d
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.URL.Path]++
+	if r.Header.Get("Range") != "" {
+		f.ranges++
+	}
+	stall := f.stall
+	f.mu.Unlock()
+	_, rest, _ := strings.Cut(r.URL.Path, "/ns/repo/")
+	kind, ref, _ := strings.Cut(rest, "/")
+	if d, ok := f.tags[ref]; ok && kind == "manifests" {
+		ref = d
+	}
+	b, ok := f.blobs[ref]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if kind == "manifests" {
+		var v struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(b, &v)
+		w.Header().Set("Content-Type", v.MediaType)
+		w.Write(b)
+		return
+	}
+	if stall > 0 && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b[:len(b)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(stall)
+		w.Write(b[len(b)/2:])
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+}
+
+func TestMirror(t *testing.T) {
+	f := &fakeRegistry{
+		blobs:    make(map[string][]byte),
+		tags:     make(map[string]string),
+		requests: make(map[string]int),
+	}
+	shared := f.add(bytes.Repeat([]byte("base"), 1024))
+	image := func(arch string) Descriptor {
+		cfg := f.add([]byte(`{"os": "linux", "architecture": "` + arch + `"}`))
+		own := f.add([]byte("layer for " + arch))
+		b, _ := json.Marshal(Manifest{
+			MediaType: mediaTypeOCIManifest,
+			Config:    Descriptor{MediaType: mediaTypeOCIConfig, Digest: cfg, Size: int64(len(f.blobs[cfg]))},
+			Layers: []Descriptor{
+				{Digest: shared, Size: int64(len(f.blobs[shared]))},
+				{Digest: own, Size: int64(len(f.blobs[own]))},
+			},
+		})
+		d := f.add(b)
+		return Descriptor{
+			MediaType: mediaTypeOCIManifest,
+			Digest:    d,
+			Size:      int64(len(b)),
+			Platform:  &Platform{OS: "linux", Architecture: arch},
+		}
+	}
+	b, _ := json.Marshal(Index{MediaType: mediaTypeOCIIndex, Manifests: []Descriptor{image("amd64"), image("arm64")}})
+	list := f.add(b)
+	f.tags["latest"] = list
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	ctx := context.Background()
+	global := &Options{PlainHTTP: true, Attempts: 1}
+	refs := []Ref{{Registry: u.Host, Namespace: "ns", Repository: "repo", Tag: "latest"}}
+	dir := t.TempDir()
+	blob := func(d string) string {
+		return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(d, "sha256:"))
+	}
+	readIndex := func() []Descriptor {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dir, "index.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idx Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			t.Fatal(err)
+		}
+		return idx.Manifests
+	}
+
+	t.Run("Platform", func(t *testing.T) {
+		amd64, _ := parsePlatform("linux/amd64")
+		if err := Mirror(ctx, global, refs, MirrorOptions{Dir: dir, Platform: amd64}); err != nil {
+			t.Fatal(err)
+		}
+		idx := readIndex()
+		if len(idx) != 1 || idx[0].Platform.Architecture != "amd64" || idx[0].Annotations[annotationRefName] != refs[0].TagRef() {
+			t.Fatalf("index: got: %+v", idx)
+		}
+		if _, err := os.Stat(blob(idx[0].Digest)); err != nil {
+			t.Error(err)
+		}
+		if _, err := os.Stat(blob(list)); err == nil {
+			t.Error("manifest list mirrored with -platform")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		// Leave half of the shared layer as a partial download.
+		p := blob(shared)
+		if err := os.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p+".partial", f.blobs[shared][:2048], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(blob(readIndex()[0].Digest)); err != nil {
+			t.Fatal(err)
+		}
+		clear(f.requests)
+
+		if err := Mirror(ctx, global, refs, MirrorOptions{Dir: dir}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, f.blobs[shared]) {
+			t.Error("resumed layer differs")
+		}
+		if f.ranges != 1 {
+			t.Errorf("range requests: got: %d, want: 1", f.ranges)
+		}
+		// The shared layer is fetched once for both images.
+		if got := f.requests["/v2/ns/repo/blobs/"+shared]; got != 1 {
+			t.Errorf("shared layer requests: got: %d, want: 1", got)
+		}
+		idx := readIndex()
+		if len(idx) != 1 || idx[0].Digest != list {
+			t.Errorf("index: got: %+v", idx)
+		}
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		dir := t.TempDir()
+		good := f.blobs[shared]
+		f.blobs[shared] = bytes.Repeat([]byte("evil"), 1024)
+		defer func() { f.blobs[shared] = good }()
+		if err := Mirror(ctx, global, refs, MirrorOptions{Dir: dir}); err == nil {
+			t.Fatal("mirrored a corrupt layer")
+		}
+		p := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(shared, "sha256:"))
+		for _, p := range []string{p, p + ".partial"} {
+			if _, err := os.Stat(p); err == nil {
+				t.Errorf("corrupt layer left in layout: %s", p)
+			}
+		}
+	})
+
+	t.Run("SlowBody", func(t *testing.T) {
+		// Reading a layer may take longer than the timeout, as long as the
+		// registry starts responding in time.
+		global := &Options{PlainHTTP: true, Attempts: 1, Timeout: 20 * time.Millisecond}
+		f.mu.Lock()
+		f.stall = 5 * global.Timeout
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.stall = 0
+			f.mu.Unlock()
+		}()
+		if err := Mirror(ctx, global, refs, MirrorOptions{Dir: t.TempDir()}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestParseRef(t *testing.T) {
+	for _, tc := range []struct {
+		In   string
+		Want Ref
+	}{
+		{"quay.io/ns/repo:latest", Ref{Registry: "quay.io", Namespace: "ns", Repository: "repo", Tag: "latest"}},
+		{"quay.io/ns/repo@sha256:abc", Ref{Registry: "quay.io", Namespace: "ns", Repository: "repo", Digest: "sha256:abc"}},
+		{"localhost:5000/ns/a/b:v1", Ref{Registry: "localhost:5000", Namespace: "ns", Repository: "a/b", Tag: "v1"}},
+	} {
+		got, err := parseRef(tc.In)
+		if err != nil {
+			t.Errorf("%s: %v", tc.In, err)
+			continue
+		}
+		if got != tc.Want {
+			t.Errorf("%s: got: %+v, want: %+v", tc.In, got, tc.Want)
+		}
+	}
+	if _, err := parseRef("quay.io/ns/repo"); err == nil {
+		t.Error("reference without tag or digest parsed")
+	}
+}
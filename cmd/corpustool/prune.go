@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// markGone marks the tags and repositories in the registry "regID" that
+// haven't been seen since before the run "pass" as gone.
+func markGone(conn *sqlite.Conn, regID, pass int64) error {
+	return sqlitex.ExecuteScriptFS(conn, sql.FS, "mark_gone.sql", &sqlitex.ExecOptions{
+		Named: map[string]any{":registry": regID, ":pass": pass},
+	})
+}
+
+// PruneOptions is the configuration for pruning gone tags and repositories.
+type PruneOptions struct {
+	// Archive copies pruned tags into the repo_tag_archive table before
+	// deleting them.
+	Archive bool
+	// OlderThan only prunes rows that have been gone for at least this long.
+	OlderThan time.Duration
+	// DryRun only reports what would be pruned.
+	DryRun bool
+}
+
+func pruneMain(ctx context.Context, db string, args []string) error {
+	var opts PruneOptions
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s prune [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&opts.Archive, "archive", true, "copy pruned tags to the repo_tag_archive table instead of only deleting them")
+	fs.DurationVar(&opts.OlderThan, "older-than", 0, "only prune rows that have been gone for at least `duration`")
+	fs.BoolVar(&opts.DryRun, "n", false, "only report what would be pruned")
+	fs.Parse(args)
+	return Prune(ctx, db, opts)
+}
+
+// Prune removes the tags and repositories marked gone from the database "db"
+// according to "opts".
+func Prune(ctx context.Context, db string, opts PruneOptions) error {
+	conn, err := sqlite.OpenConn(db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+	if err := migrate(ctx, conn); err != nil {
+		return err
+	}
+
+	before := time.Now().Add(-opts.OlderThan).Unix()
+	tags, repos, err := prune(conn, before, opts)
+	if err != nil {
+		return err
+	}
+	msg := "pruned"
+	if opts.DryRun {
+		msg = "would prune"
+	}
+	slog.InfoContext(ctx, msg, "tags", tags, "repositories", repos, "archive", opts.Archive)
+	return nil
+}
+
+// prune removes the rows marked gone at or before the Unix time "before" in a
+// single transaction, and reports how many tags and repositories there were.
+func prune(conn *sqlite.Conn, before int64, opts PruneOptions) (tags, repos int, err error) {
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer endFn(&err)
+
+	err = sqlitex.ExecuteFS(conn, sql.FS, "count_gone.sql", &sqlitex.ExecOptions{
+		Args: []any{before},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tags, repos = stmt.ColumnInt(0), stmt.ColumnInt(1)
+			return nil
+		},
+	})
+	if err != nil || opts.DryRun {
+		return tags, repos, err
+	}
+	if opts.Archive {
+		err = sqlitex.ExecuteFS(conn, sql.FS, "archive_gone.sql", &sqlitex.ExecOptions{
+			Args: []any{before},
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = sqlitex.ExecuteScriptFS(conn, sql.FS, "delete_gone.sql", &sqlitex.ExecOptions{
+		Named: map[string]any{":before": before},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return tags, repos, nil
+}
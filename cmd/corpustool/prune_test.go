@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestPrune(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	w.Budget = ErrorBudget{Limit: 1}
+	writeResults(t, w, []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags: []Tag{
+				{Name: "latest", Digest: "sha256:1"},
+				{Name: "old", Digest: "sha256:2"},
+			},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "deleted"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:3"}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "private"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:4"}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "broken"}, Page: 1},
+			Err:       &ResponseError{StatusCode: 500, Status: "500 Internal Server Error"},
+		},
+	})
+
+	// The second pass no longer sees "ns/a:old", "ns/deleted" or "ns/broken",
+	// and can't fetch "ns/private".
+	w = newTestWriter(t, conn)
+	w.Budget = ErrorBudget{Limit: 1}
+	writeResults(t, w, []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:1"}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "private"}, Page: 1},
+			Err:       &ResponseError{StatusCode: 403, Status: "403 Forbidden"},
+		},
+	})
+	if got, want := queryString(t, conn, `SELECT ref FROM refs ORDER BY ref;`),
+		"quay.io/ns/a:latest,quay.io/ns/a:old,quay.io/ns/deleted:latest,quay.io/ns/private:latest"; got != want {
+		t.Errorf("before marking: got: %q, want: %q", got, want)
+	}
+
+	if err := markGone(conn, w.regID, w.passRun); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ q, want string }{
+		{`SELECT ref FROM refs ORDER BY ref;`, "quay.io/ns/a:latest,quay.io/ns/private:latest"},
+		{`SELECT count(*) FROM repo_tag WHERE gone IS NOT NULL;`, "2"},
+		{`SELECT r.value FROM repository_seen JOIN repository_name AS r ON (repository = r.id) WHERE gone IS NOT NULL ORDER BY 1;`, "broken,deleted"},
+	} {
+		if got := queryString(t, conn, tc.q); got != tc.want {
+			t.Errorf("%s: got: %q, want: %q", tc.q, got, tc.want)
+		}
+	}
+
+	tags, repos, err := prune(conn, 1<<62, PruneOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags != 2 || repos != 2 {
+		t.Errorf("dry run: got: %d tags, %d repositories, want: 2, 2", tags, repos)
+	}
+	if got, want := queryString(t, conn, `SELECT count(*) FROM repo_tag;`), "4"; got != want {
+		t.Errorf("dry run deleted rows: got: %s, want: %s", got, want)
+	}
+
+	if _, _, err := prune(conn, 1<<62, PruneOptions{Archive: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ q, want string }{
+		{`SELECT count(*) FROM repo_tag;`, "2"},
+		{`SELECT count(*) FROM run_tag;`, "4"},
+		{`SELECT namespace || '/' || repository || ':' || tag || '@' || digest FROM repo_tag_archive ORDER BY 1;`, "ns/a:old@sha256:2,ns/deleted:latest@sha256:3"},
+		{`SELECT count(*) FROM repository_seen;`, "2"},
+		{`SELECT r.value FROM repository_fetch JOIN repository_name AS r ON (repository = r.id) ORDER BY 1;`, "a,private"},
+		{`SELECT r.value FROM fetch_error JOIN repository_name AS r ON (repository = r.id);`, "private"},
+	} {
+		if got := queryString(t, conn, tc.q); got != tc.want {
+			t.Errorf("%s: got: %q, want: %q", tc.q, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/maphash"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Lister = (*client)(nil)
+
+// client is a [Lister] using the Quay v1 API.
+type client struct {
+	c    *http.Client
+	root *url.URL
+	Auth Credentials
+	// Query is the repository search query. If empty, "*" is used.
+	Query string
+	// Shard splits the search into queries by name prefix, to get past the
+	// limit on how many pages of results the API returns. Query is not
+	// used.
+	Shard bool
+
+	truncated bool
+}
+
+func NewClient(c *http.Client, root string) (*client, error) {
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		c:    c,
+		root: u,
+	}, nil
+}
+
+// Repositories pages through the repository search results, starting at page
+// "start". The returned sequence yields each repository along with the page it
+// was found on and the metadata from the search result.
+//
+// If Shard is set, the search is split into prefix queries, and pages are
+// numbered so that each shard has its own range; see [client.shard].
+func (c *client) Repositories(ctx context.Context, start int) (iter.Seq[pagedRepo], func() error) {
+	var errReturn error
+	errFunc := func() error { return errReturn }
+	seq := func(yield func(pagedRepo) bool) {
+		s := &search{
+			dup:   make(map[uint64]struct{}),
+			seed:  maphash.MakeSeed(),
+			yield: yield,
+		}
+		s.buf.Grow(1 << 20)
+
+		var err error
+		if c.Shard {
+			err = c.shard(ctx, s, "", start)
+		} else {
+			query := c.Query
+			if query == "" {
+				query = "*"
+			}
+			var saturated bool
+			saturated, err = c.search(ctx, s, query, max(start, 1), 0)
+			if saturated {
+				c.truncated = true
+			}
+		}
+		if !errors.Is(err, errStopped) {
+			errReturn = err
+		}
+	}
+
+	return seq, errFunc
+}
+
+// Truncated reports whether the last walk of [client.Repositories] left out
+// results because the search stopped returning pages.
+func (c *client) Truncated() bool {
+	return c.truncated
+}
+
+// search is the state of one walk through the search results, shared by all
+// the queries it makes.
+type search struct {
+	buf bytes.Buffer
+	// dup is the set of repositories already yielded, by href, so that
+	// overlapping queries don't yield them twice.
+	dup   map[uint64]struct{}
+	seed  maphash.Seed
+	yield func(pagedRepo) bool
+}
+
+// errStopped is returned when the consumer of a search stops early.
+var errStopped = errors.New("search stopped")
+
+// search pages through the results for "query" starting at page "start",
+// yielding each repository with its page number offset by "base". It reports
+// whether there were more results than the API would return.
+func (c *client) search(ctx context.Context, s *search, query string, start, base int) (saturated bool, err error) {
+	const maxPage = 100
+	page := start
+	endpt := c.root.JoinPath("find", "repositories")
+	for {
+		u := *endpt
+		v := u.Query()
+		v.Set("includeUsage", "false")
+		v.Set("query", query)
+		v.Set("page", strconv.Itoa(page))
+		u.RawQuery = v.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set(`Accept`, `application/json`)
+		c.Auth.APIAuth(req)
+
+		slog.DebugContext(ctx, "making request", "page", page, "url", u.String())
+		res, err := c.c.Do(req)
+		if err != nil {
+			return false, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return false, responseError(res)
+		}
+		s.buf.Reset()
+		_, err = io.Copy(&s.buf, res.Body)
+		if err := errors.Join(err, res.Body.Close()); err != nil {
+			return false, err
+		}
+
+		var findres FindRepositoriesResult
+		if err := json.Unmarshal(s.buf.Bytes(), &findres); err != nil {
+			return false, err
+		}
+
+		// The Quay API is really odd here and will just return page 10
+		// forever, so stop walking if this isn't the page requested.
+		if page != findres.Page {
+			slog.DebugContext(ctx, "search results cut off", "query", query, "page", page)
+			return true, nil
+		}
+
+		for _, r := range findres.Results {
+			id := maphash.String(s.seed, r.Href)
+			if _, ok := s.dup[id]; ok {
+				slog.DebugContext(ctx, "skip repo", "page", findres.Page, "additional", findres.Additional, "href", r.Href)
+				continue
+			}
+			s.dup[id] = struct{}{}
+			out := pagedRepo{
+				Repo: Repo{
+					Namespace: r.Namespace.Name,
+					Name:      r.Name,
+				},
+				Page: base + findres.Page,
+				Meta: &RepoMeta{
+					Description:   r.Description,
+					Public:        r.IsPublic,
+					Kind:          r.Kind,
+					Popularity:    r.Popularity,
+					LastModified:  time.Time(r.LastModified),
+					NamespaceKind: r.Namespace.Kind,
+				},
+			}
+			if !s.yield(out) {
+				return false, errStopped
+			}
+		}
+
+		if !findres.Additional {
+			return false, nil
+		}
+		page++
+		// In case the Quay API starts being normal:
+		if page >= maxPage {
+			return true, nil
+		}
+	}
+}
+
+// Sharding parameters.
+//
+// A shard is a prefix of up to shardDepth characters from shardChars, searched
+// as "prefix*". Every shard has shardPages pages reserved for it, numbered so
+// that the pages of a shard, then those of its longer prefixes, come before
+// the next shard's in walk order. That keeps the page number a checkpoint
+// saves meaningful across runs.
+const (
+	// shardChars are the characters a repository name can contain. Names
+	// start with one of the first 36.
+	shardChars = "0123456789abcdefghijklmnopqrstuvwxyz-._"
+	shardDepth = 4
+	// shardPages is enough for the 10 pages Quay returns.
+	shardPages = 16
+)
+
+// shardBase returns the page number just before the first page of "prefix",
+// and the number of pages reserved for it and all its longer prefixes.
+func shardBase(prefix string) (base, span int) {
+	const radix = len(shardChars) + 1
+	span = shardPages
+	for range shardDepth - len(prefix) {
+		span *= radix
+	}
+	n := 0
+	for i := range shardDepth {
+		n *= radix
+		if i < len(prefix) {
+			n += strings.IndexByte(shardChars, prefix[i]) + 1
+		}
+	}
+	return n * shardPages, span
+}
+
+// shard walks the results for "prefix*", starting at the global page
+// "start", and if there are more than the API returns, the shards for each
+// longer prefix in turn. The empty prefix is never searched itself.
+func (c *client) shard(ctx context.Context, s *search, prefix string, start int) error {
+	base, span := shardBase(prefix)
+	if start > base+span {
+		// Already walked.
+		return nil
+	}
+	// If "start" is past this shard's own pages, it was subdivided.
+	saturated := true
+	if prefix != "" && start <= base+shardPages {
+		var err error
+		saturated, err = c.search(ctx, s, prefix+"*", max(start-base, 1), base)
+		if err != nil {
+			return err
+		}
+	}
+	if !saturated {
+		return nil
+	}
+	if len(prefix) == shardDepth {
+		slog.WarnContext(ctx, "search shard has too many results, some will be missed", "prefix", prefix)
+		c.truncated = true
+		return nil
+	}
+	chars := shardChars
+	if prefix == "" {
+		chars = chars[:36]
+	}
+	for _, ch := range []byte(chars) {
+		if err := c.shard(ctx, s, prefix+string(ch), start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type FindRepositoriesResult struct {
+	Results []struct {
+		Name      string `json:"name"`
+		Namespace struct {
+			Name string `json:"name"`
+			Kind string `json:"kind"`
+		} `json:"namespace"`
+		Href         string   `json:"href"`
+		Description  string   `json:"description"`
+		IsPublic     bool     `json:"is_public"`
+		Kind         string   `json:"kind"`
+		Popularity   float64  `json:"popularity"`
+		LastModified quayTime `json:"last_modified"`
+	} `json:"results"`
+	Additional bool `json:"has_additional"`
+	Page       int  `json:"page"`
+}
+
+func (c *client) Tags(ctx context.Context, repo Repo) (iter.Seq[Tag], func() error) {
+	var errReturn error
+	errFunc := func() error { return errReturn }
+	seq := func(yield func(Tag) bool) {
+		page := 1
+		additional := true
+		var buf bytes.Buffer
+		buf.Grow(1 << 20)
+
+		endpt := c.root.JoinPath("repository", repo.Namespace, repo.Name, "tag", "")
+		for additional {
+			u := *endpt
+			v := u.Query()
+			v.Set("page", strconv.Itoa(page))
+			v.Set("limit", "100")
+			v.Set("onlyActiveTags", "true")
+			u.RawQuery = v.Encode()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+			if err != nil {
+				errReturn = err
+				return
+			}
+			req.Header.Set(`Accept`, `application/json`)
+			c.Auth.APIAuth(req)
+
+			res, err := c.c.Do(req)
+			if err != nil {
+				errReturn = err
+				return
+			}
+			if res.StatusCode != http.StatusOK {
+				res.Body.Close()
+				errReturn = responseError(res)
+				return
+			}
+			buf.Reset()
+			_, err = io.Copy(&buf, res.Body)
+			if err := errors.Join(err, res.Body.Close()); err != nil {
+				errReturn = err
+				return
+			}
+
+			var tagsres ListTagsResult
+			if err := json.Unmarshal(buf.Bytes(), &tagsres); err != nil {
+				errReturn = err
+				return
+			}
+
+			for _, t := range tagsres.Tags {
+				out := Tag{
+					Name:         t.Name,
+					Digest:       t.Digest,
+					IsList:       t.IsList,
+					LastModified: parseQuayTime(t.LastModified),
+					Expiration:   parseQuayTime(t.Expiration),
+				}
+				if t.StartTS != 0 {
+					out.Started = time.Unix(t.StartTS, 0)
+				}
+				if t.Size != nil {
+					out.Size = *t.Size
+				}
+				if !yield(out) {
+					return
+				}
+			}
+
+			additional = tagsres.Additional
+			page++
+		}
+	}
+
+	return seq, errFunc
+}
+
+type ListTagsResult struct {
+	Tags []struct {
+		Name   string `json:"name"`
+		Digest string `json:"manifest_digest"`
+		IsList bool   `json:"is_manifest_list"`
+		// StartTS is a Unix time.
+		StartTS int64 `json:"start_ts"`
+		// LastModified and Expiration are RFC 1123 dates.
+		LastModified string `json:"last_modified"`
+		Expiration   string `json:"expiration"`
+		Size         *int64 `json:"size"`
+	} `json:"tags"`
+	Additional bool `json:"has_additional"`
+	Page       int  `json:"page"`
+}
+
+// quayTime is a time from the Quay API, which is a Unix time in some responses
+// and an RFC 1123 date in others. It's left as the zero time if it's neither.
+type quayTime time.Time
+
+func (t *quayTime) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		if n != 0 {
+			*t = quayTime(time.Unix(n, 0))
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = quayTime(parseQuayTime(s))
+	}
+	return nil
+}
+
+// parseQuayTime parses a date as formatted by the Quay API, returning the zero
+// time if it's empty or malformed.
+func parseQuayTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
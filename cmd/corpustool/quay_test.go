@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repository/ns/repo/tag" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"page": 1, "has_additional": false, "tags": [
+{"name": "latest", "manifest_digest": "sha256:1", "is_manifest_list": true,
+ "start_ts": 1700000000, "last_modified": "Tue, 14 Nov 2023 22:13:20 -0000", "size": 1234},
+{"name": "ci-42", "manifest_digest": "sha256:2", "is_manifest_list": false,
+ "start_ts": 1700000000, "last_modified": "Tue, 14 Nov 2023 22:13:20 -0000", "size": null,
+ "expiration": "Tue, 21 Nov 2023 22:13:20 -0000"}
+]}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.Client(), srv.URL+"/api/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, check := c.Tags(context.Background(), Repo{Namespace: "ns", Name: "repo"})
+	tags := slices.Collect(seq)
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("got %d tags, want 2", len(tags))
+	}
+
+	mod := time.Unix(1700000000, 0)
+	latest, ci := tags[0], tags[1]
+	if !latest.Started.Equal(mod) || !latest.LastModified.Equal(mod) {
+		t.Errorf("latest: got: started %v, modified %v, want: %v", latest.Started, latest.LastModified, mod)
+	}
+	if got, want := latest.Size, int64(1234); got != want {
+		t.Errorf("latest size: got: %d, want: %d", got, want)
+	}
+	if !latest.Expiration.IsZero() {
+		t.Errorf("latest expiration: got: %v, want: none", latest.Expiration)
+	}
+	if got, want := ci.Expiration, mod.Add(7*24*time.Hour); !got.Equal(want) {
+		t.Errorf("ci expiration: got: %v, want: %v", got, want)
+	}
+
+	now := mod.Add(30 * 24 * time.Hour)
+	for _, tc := range []struct {
+		Name   string
+		Filter Filter
+		Want   []string
+	}{
+		{"None", Filter{}, []string{"latest", "ci-42"}},
+		{"SkipExpiring", Filter{SkipExpiring: true}, []string{"latest"}},
+		{"ModifiedWithin", Filter{ModifiedWithin: 24 * time.Hour}, nil},
+		{"ModifiedWithinLonger", Filter{ModifiedWithin: 90 * 24 * time.Hour}, []string{"latest", "ci-42"}},
+		{"Lists", Filter{ManifestKind: "list"}, []string{"latest"}},
+		{"Single", Filter{ManifestKind: "single"}, []string{"ci-42"}},
+		{"Both", Filter{ManifestKind: "both"}, []string{"latest", "ci-42"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var got []string
+			for _, tag := range tags {
+				if tc.Filter.TagMeta(&tag, now) {
+					got = append(got, tag.Name)
+				}
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("got: %q, want: %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestRepositoryMetadata(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/find/repositories" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"page": 1, "has_additional": false, "results": [
+{"kind": "repository", "name": "app", "href": "/repository/org/app",
+ "namespace": {"name": "org", "kind": "organization"},
+ "description": "An app.", "is_public": true, "popularity": 12.5, "last_modified": 1700000000},
+{"kind": "repository", "name": "scratch", "href": "/repository/someone/scratch",
+ "namespace": {"name": "someone", "kind": "user"},
+ "description": null, "is_public": false}
+]}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.Client(), srv.URL+"/api/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, check := c.Repositories(context.Background(), 1)
+	repos := slices.Collect(seq)
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("got %d repositories, want 2", len(repos))
+	}
+	want := RepoMeta{
+		Description:   "An app.",
+		Public:        true,
+		Kind:          "repository",
+		Popularity:    12.5,
+		LastModified:  time.Unix(1700000000, 0),
+		NamespaceKind: "organization",
+	}
+	if got := *repos[0].Meta; got != want {
+		t.Errorf("got: %+v, want: %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		Name   string
+		Filter Filter
+		Want   []string
+	}{
+		{"None", Filter{}, []string{"app", "scratch"}},
+		{"Public", Filter{PublicOnly: true}, []string{"app"}},
+		{"Organizations", Filter{NamespaceKind: "organization"}, []string{"app"}},
+		{"Users", Filter{NamespaceKind: "user"}, []string{"scratch"}},
+		{"MinPopularity", Filter{MinPopularity: 10}, []string{"app"}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var got []string
+			for _, r := range repos {
+				if tc.Filter.RepoMeta(r.Meta) {
+					got = append(got, r.Name)
+				}
+			}
+			if !slices.Equal(got, tc.Want) {
+				t.Errorf("got: %q, want: %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestShardedSearch(t *testing.T) {
+	names := []string{"a1", "a2", "a3", "a4", "a5", "ab", "b-x", "b.y", "c", "z9"}
+	// The server returns two results a page and, like Quay, repeats its last
+	// page past page 2.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		prefix, ok := strings.CutSuffix(q.Get("query"), "*")
+		if !ok {
+			prefix = ""
+		}
+		var match []string
+		for _, n := range names {
+			if strings.HasPrefix(n, prefix) {
+				match = append(match, n)
+			}
+		}
+		page, _ := strconv.Atoi(q.Get("page"))
+		page = min(page, 2)
+		type result struct {
+			Name      string            `json:"name"`
+			Namespace map[string]string `json:"namespace"`
+			Href      string            `json:"href"`
+		}
+		out := struct {
+			Results    []result `json:"results"`
+			Additional bool     `json:"has_additional"`
+			Page       int      `json:"page"`
+		}{Page: page, Additional: len(match) > page*2}
+		for _, n := range match[min((page-1)*2, len(match)):min(page*2, len(match))] {
+			out.Results = append(out.Results, result{n, map[string]string{"name": "ns"}, "/repository/ns/" + n})
+		}
+		json.NewEncoder(w).Encode(&out)
+	}))
+	defer srv.Close()
+
+	walk := func(c *client, start int) []pagedRepo {
+		t.Helper()
+		seq, check := c.Repositories(context.Background(), start)
+		out := slices.Collect(seq)
+		if err := check(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	c, err := NewClient(srv.Client(), srv.URL+"/api/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Unsharded", func(t *testing.T) {
+		if got := walk(c, 1); len(got) != 4 || !c.Truncated() {
+			t.Errorf("got %d repositories, truncated %v, want 4, true", len(got), c.Truncated())
+		}
+	})
+
+	c.Shard = true
+	c.truncated = false
+	got := walk(c, 1)
+	var seen []string
+	for i, pr := range got {
+		seen = append(seen, pr.Name)
+		if i > 0 && pr.Page < got[i-1].Page {
+			t.Errorf("page went backwards at %s: %d after %d", pr.Name, pr.Page, got[i-1].Page)
+		}
+	}
+	slices.Sort(seen)
+	if !slices.Equal(seen, names) {
+		t.Errorf("got: %q, want: %q", seen, names)
+	}
+	if c.Truncated() {
+		t.Error("sharded search truncated")
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		// Resuming from the page a repository was found on yields it and
+		// everything after it again.
+		i := slices.IndexFunc(got, func(pr pagedRepo) bool { return pr.Name == "a5" })
+		var want []string
+		for _, pr := range got[i:] {
+			want = append(want, pr.Name)
+		}
+		var resumed []string
+		for _, pr := range walk(c, got[i].Page) {
+			resumed = append(resumed, pr.Name)
+		}
+		if !slices.Equal(resumed, want) {
+			t.Errorf("got: %q, want: %q", resumed, want)
+		}
+	})
+}
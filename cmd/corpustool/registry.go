@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Lister = (*registry)(nil)
+
+// Media types for the manifest formats the registry client understands.
+const (
+	mediaTypeOCIIndex    = `application/vnd.oci.image.index.v1+json`
+	mediaTypeOCIManifest = `application/vnd.oci.image.manifest.v1+json`
+	mediaTypeDockerList  = `application/vnd.docker.distribution.manifest.list.v2+json`
+	mediaTypeDockerImage = `application/vnd.docker.distribution.manifest.v2+json`
+)
+
+// manifestAccept is the Accept header sent for manifest requests.
+var manifestAccept = strings.Join([]string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerList,
+	mediaTypeDockerImage,
+}, ", ")
+
+// isListType reports whether "mt" is a manifest list media type.
+func isListType(mt string) bool {
+	return mt == mediaTypeOCIIndex || mt == mediaTypeDockerList
+}
+
+// registry is a client for the OCI Distribution API.
+//
+// It handles the bearer token flow, caching a token per repository until it
+// expires. If credentials are provided, they're presented when requesting
+// tokens.
+type registry struct {
+	c    *http.Client
+	root *url.URL
+	Auth Credentials
+	// Blobs is the client used to download blobs, which can take far longer
+	// than any other request. If nil, the registry's client is used.
+	Blobs *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]bearerToken
+	// short is done once tokens shorter than requested have been warned
+	// about.
+	short sync.Once
+}
+
+// bearerToken is a token from a registry's token service.
+type bearerToken struct {
+	Value   string
+	Expires time.Time
+	// Lifetime is how long the token was issued for.
+	Lifetime time.Duration
+	// Challenge is the challenge the token was requested for, to refresh it
+	// without another round trip.
+	Challenge string
+}
+
+// Token lifetimes.
+const (
+	// defaultTokenLifetime is assumed for tokens that don't say when they
+	// expire, as the distribution token spec prescribes.
+	defaultTokenLifetime = 60 * time.Second
+	// tokenLeeway is how long a cached token must still be valid for to be
+	// sent, to allow for clock skew and slow requests.
+	tokenLeeway = 5 * time.Second
+)
+
+func NewRegistry(c *http.Client, root string) (*registry, error) {
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	return &registry{
+		c:      c,
+		root:   u,
+		tokens: make(map[string]bearerToken),
+	}, nil
+}
+
+// Host reports the registry host, as used in image references.
+func (r *registry) Host() string {
+	return r.root.Host
+}
+
+// Descriptor is an OCI content descriptor.
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+	// Annotations are only used in the index of an image layout.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform is the platform an image in an index is for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Index is an OCI image index or Docker manifest list.
+type Index struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// Manifest is an OCI image manifest or Docker image manifest.
+type Manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+// ImageManifest fetches the image manifest "ref" in the repository "name".
+func (r *registry) ImageManifest(ctx context.Context, name, ref string) (*Manifest, error) {
+	b, mt, err := r.Manifest(ctx, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.MediaType == "" {
+		m.MediaType = mt
+	}
+	if isListType(m.MediaType) {
+		return nil, fmt.Errorf("%s@%s: not an image manifest: %q", name, ref, m.MediaType)
+	}
+	return &m, nil
+}
+
+// Index fetches the manifest list "ref" in the repository "name".
+func (r *registry) Index(ctx context.Context, name, ref string) (*Index, error) {
+	b, mt, err := r.Manifest(ctx, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	if idx.MediaType == "" {
+		idx.MediaType = mt
+	}
+	if !isListType(idx.MediaType) {
+		return nil, fmt.Errorf("%s@%s: not a manifest list: %q", name, ref, idx.MediaType)
+	}
+	return &idx, nil
+}
+
+// Manifest fetches the manifest "ref" in the repository "name", returning the
+// raw bytes and the reported media type.
+func (r *registry) Manifest(ctx context.Context, name, ref string) ([]byte, string, error) {
+	u := r.root.JoinPath("v2", name, "manifests", ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set(`Accept`, manifestAccept)
+
+	res, err := r.do(ctx, req, pullScope(name))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", responseError(res)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, res.Body); err != nil {
+		return nil, "", err
+	}
+	mt, _, _ := mime.ParseMediaType(res.Header.Get(`Content-Type`))
+	return buf.Bytes(), mt, nil
+}
+
+// Blob fetches the blob "digest" in the repository "name". The caller must
+// close the returned body.
+func (r *registry) Blob(ctx context.Context, name, digest string) (io.ReadCloser, error) {
+	rc, _, err := r.BlobFrom(ctx, name, digest, 0)
+	return rc, err
+}
+
+// BlobFrom fetches the blob "digest" in the repository "name", starting at
+// byte "offset" if the registry supports it. It reports whether the returned
+// body starts at "offset" rather than at the beginning of the blob. The caller
+// must close the returned body.
+func (r *registry) BlobFrom(ctx context.Context, name, digest string, offset int64) (io.ReadCloser, bool, error) {
+	u := r.root.JoinPath("v2", name, "blobs", digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset > 0 {
+		req.Header.Set(`Range`, fmt.Sprintf("bytes=%d-", offset))
+	}
+	res, err := r.send(ctx, cmp.Or(r.Blobs, r.c), req, pullScope(name))
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return res.Body, false, nil
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+		return res.Body, true, nil
+	}
+	res.Body.Close()
+	return nil, false, responseError(res)
+}
+
+// PullAuth returns the Authorization header value needed to pull blobs from
+// the repository "name" without going through this client, such as for layer
+// URIs handed to Clair. It's empty if the registry doesn't ask for
+// credentials. Tokens are requested to stay valid for "lifetime"; see
+// [registry.bearer].
+func (r *registry) PullAuth(ctx context.Context, name string, lifetime time.Duration) (string, error) {
+	scope := pullScope(name)
+	lifetime = max(lifetime, tokenLeeway)
+	tok, ok, err := r.bearer(ctx, scope, lifetime)
+	switch {
+	case err != nil:
+		return "", err
+	case ok:
+		return `Bearer ` + tok, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.root.JoinPath("v2/").String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := r.c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return "", nil
+	case http.StatusUnauthorized:
+	default:
+		return "", responseError(res)
+	}
+
+	chal := res.Header.Get(`WWW-Authenticate`)
+	if scheme, _, _ := strings.Cut(chal, " "); strings.EqualFold(scheme, "basic") {
+		r.Auth.RegistryAuth(req)
+		return req.Header.Get(`Authorization`), nil
+	}
+	tok, err = r.newToken(ctx, chal, scope, lifetime)
+	if err != nil {
+		return "", err
+	}
+	return `Bearer ` + tok, nil
+}
+
+// pullScope is the token scope needed to pull from the repository "name".
+func pullScope(name string) string {
+	return "repository:" + name + ":pull"
+}
+
+// do issues "req", negotiating a token for "scope" if the registry asks for
+// one. A cached token the registry rejects is dropped and negotiated again
+// once.
+func (r *registry) do(ctx context.Context, req *http.Request, scope string) (*http.Response, error) {
+	return r.send(ctx, r.c, req, scope)
+}
+
+// send is [registry.do] with the client "c" in place of the registry's own.
+// Token requests still go through the registry's client.
+func (r *registry) send(ctx context.Context, c *http.Client, req *http.Request, scope string) (*http.Response, error) {
+	tok, cached, err := r.bearer(ctx, scope, tokenLeeway)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		req.Header.Set(`Authorization`, `Bearer `+tok)
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+	res.Body.Close()
+	if cached {
+		slog.DebugContext(ctx, "cached token rejected", "scope", scope)
+		r.forgetToken(scope, tok)
+	}
+
+	chal := res.Header.Get(`WWW-Authenticate`)
+	req = req.Clone(ctx)
+	if scheme, _, _ := strings.Cut(chal, " "); strings.EqualFold(scheme, "basic") {
+		req.Header.Del(`Authorization`)
+		r.Auth.RegistryAuth(req)
+		return c.Do(req)
+	}
+	tok, err = r.newToken(ctx, chal, scope, tokenLeeway)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Authorization`, `Bearer `+tok)
+	return c.Do(req)
+}
+
+// bearer returns a token for "scope" that's valid for at least "lifetime"
+// longer, refreshing a cached one that isn't. It reports false if there's no
+// token to send because the registry hasn't asked for one yet.
+//
+// If the registry issues tokens shorter than "lifetime", a fresh one would be
+// no better, so a cached one is used until half of it is spent.
+func (r *registry) bearer(ctx context.Context, scope string, lifetime time.Duration) (string, bool, error) {
+	r.mu.Lock()
+	tok, ok := r.tokens[scope]
+	r.mu.Unlock()
+	switch {
+	case !ok:
+		return "", false, nil
+	case time.Until(tok.Expires) >= min(lifetime, tok.Lifetime/2):
+		return tok.Value, true, nil
+	}
+	slog.DebugContext(ctx, "refreshing token", "scope", scope, "expires", tok.Expires)
+	v, err := r.newToken(ctx, tok.Challenge, scope, lifetime)
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// forgetToken drops the cached token for "scope" if it's still "tok", so a
+// token another request already replaced is kept.
+func (r *registry) forgetToken(scope, tok string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens[scope].Value == tok {
+		delete(r.tokens, scope)
+	}
+}
+
+// newToken requests a token for "scope" according to the challenge "chal"
+// and caches it. It warns, once per registry, if the token isn't valid for
+// "lifetime".
+func (r *registry) newToken(ctx context.Context, chal, scope string, lifetime time.Duration) (string, error) {
+	tok, err := r.token(ctx, chal, scope)
+	if err != nil {
+		return "", err
+	}
+	if tok.Lifetime < lifetime {
+		r.short.Do(func() {
+			slog.WarnContext(ctx, "registry issues tokens shorter than needed, reusing them until half spent",
+				"lifetime", tok.Lifetime, "need", lifetime)
+		})
+	}
+	r.mu.Lock()
+	r.tokens[scope] = tok
+	r.mu.Unlock()
+	return tok.Value, nil
+}
+
+// token requests a token for "scope" according to the challenge "chal".
+func (r *registry) token(ctx context.Context, chal, scope string) (bearerToken, error) {
+	var tok bearerToken
+	scheme, params, ok := strings.Cut(chal, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return tok, fmt.Errorf("unsupported auth challenge: %q", chal)
+	}
+	p := parseChallenge(params)
+	realm := p["realm"]
+	if realm == "" {
+		return tok, errors.New("auth challenge missing realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return tok, err
+	}
+	v := u.Query()
+	if s, ok := p["service"]; ok {
+		v.Set("service", s)
+	}
+	v.Set("scope", scope)
+
+	var req *http.Request
+	if it := r.Auth.IdentityToken; it != "" {
+		// An identity token is exchanged with the OAuth2 refresh token grant
+		// instead of being presented as basic credentials.
+		v.Set("grant_type", "refresh_token")
+		v.Set("refresh_token", it)
+		v.Set("client_id", "corpustool")
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(v.Encode()))
+		if err != nil {
+			return tok, err
+		}
+		req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	} else {
+		u.RawQuery = v.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return tok, err
+		}
+		r.Auth.RegistryAuth(req)
+	}
+	req.Header.Set(`Accept`, `application/json`)
+	slog.DebugContext(ctx, "requesting token", "url", u.String())
+	requested := time.Now()
+	res, err := r.c.Do(req)
+	if err != nil {
+		return tok, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return tok, responseError(res)
+	}
+	var tokres struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokres); err != nil {
+		return tok, err
+	}
+	tok.Value = cmp.Or(tokres.Token, tokres.AccessToken)
+	// Trust the token service's issue time only if it's earlier, in case
+	// its clock is ahead.
+	issued := requested
+	if !tokres.IssuedAt.IsZero() && tokres.IssuedAt.Before(requested) {
+		issued = tokres.IssuedAt
+	}
+	life := defaultTokenLifetime
+	if tokres.ExpiresIn > 0 {
+		life = time.Duration(tokres.ExpiresIn) * time.Second
+	}
+	tok.Expires = issued.Add(life)
+	tok.Lifetime = life
+	tok.Challenge = chal
+	return tok, nil
+}
+
+// parseChallenge parses the comma-separated key="value" pairs of a
+// WWW-Authenticate challenge.
+func parseChallenge(s string) map[string]string {
+	out := make(map[string]string)
+	for s != "" {
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			v, rest, _ = strings.Cut(rest[1:], `"`)
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			v, rest, _ = strings.Cut(rest, ",")
+		}
+		out[k] = strings.TrimSpace(v)
+		s = rest
+	}
+	return out
+}
+
+// Repositories pages through the registry's catalog.
+//
+// The catalog is paged with Link headers, so there's no way to jump to a page.
+// Pages are counted from 1 and pages before "start" are walked without
+// yielding anything.
+func (r *registry) Repositories(ctx context.Context, start int) (iter.Seq[pagedRepo], func() error) {
+	var errReturn error
+	errFunc := func() error { return errReturn }
+	seq := func(yield func(pagedRepo) bool) {
+		u := r.root.JoinPath("v2", "_catalog")
+		v := u.Query()
+		v.Set("n", "100")
+		u.RawQuery = v.Encode()
+		for page := 1; u != nil; page++ {
+			var res struct {
+				Repositories []string `json:"repositories"`
+			}
+			slog.DebugContext(ctx, "making request", "page", page, "url", u.String())
+			next, err := r.getJSON(ctx, u, "registry:catalog:*", &res)
+			if err != nil {
+				errReturn = err
+				return
+			}
+			u = next
+			if page < start {
+				continue
+			}
+			for _, name := range res.Repositories {
+				if !yield(pagedRepo{Repo: splitName(name), Page: page}) {
+					return
+				}
+			}
+		}
+	}
+	return seq, errFunc
+}
+
+// Tags lists the tags in "repo" and resolves each one to a manifest digest.
+func (r *registry) Tags(ctx context.Context, repo Repo) (iter.Seq[Tag], func() error) {
+	var errReturn error
+	errFunc := func() error { return errReturn }
+	seq := func(yield func(Tag) bool) {
+		name := path.Join(repo.Namespace, repo.Name)
+		u := r.root.JoinPath("v2", name, "tags", "list")
+		v := u.Query()
+		v.Set("n", "100")
+		u.RawQuery = v.Encode()
+		for u != nil {
+			var res struct {
+				Tags []string `json:"tags"`
+			}
+			next, err := r.getJSON(ctx, u, pullScope(name), &res)
+			if err != nil {
+				errReturn = err
+				return
+			}
+			u = next
+			for _, t := range res.Tags {
+				d, err := r.Head(ctx, name, t)
+				if err != nil {
+					errReturn = err
+					return
+				}
+				out := Tag{
+					Name:   t,
+					Digest: d.Digest,
+					IsList: isListType(d.MediaType),
+				}
+				if !yield(out) {
+					return
+				}
+			}
+		}
+	}
+	return seq, errFunc
+}
+
+// Head resolves the manifest "ref" in the repository "name" to a descriptor.
+//
+// If the registry doesn't report the digest, the manifest is fetched and
+// hashed.
+func (r *registry) Head(ctx context.Context, name, ref string) (Descriptor, error) {
+	var d Descriptor
+	u := r.root.JoinPath("v2", name, "manifests", ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return d, err
+	}
+	req.Header.Set(`Accept`, manifestAccept)
+	res, err := r.do(ctx, req, pullScope(name))
+	if err != nil {
+		return d, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return d, responseError(res)
+	}
+	d.MediaType, _, _ = mime.ParseMediaType(res.Header.Get(`Content-Type`))
+	d.Digest = res.Header.Get(`Docker-Content-Digest`)
+	d.Size = res.ContentLength
+	if d.Digest != "" {
+		return d, nil
+	}
+
+	b, mt, err := r.Manifest(ctx, name, ref)
+	if err != nil {
+		return d, err
+	}
+	sum := sha256.Sum256(b)
+	d.MediaType = mt
+	d.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	d.Size = int64(len(b))
+	return d, nil
+}
+
+// getJSON fetches "u" and decodes the response into "v", returning the "next"
+// URL from the Link header, if any.
+func (r *registry) getJSON(ctx context.Context, u *url.URL, scope string, v any) (*url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Accept`, `application/json`)
+	res, err := r.do(ctx, req, scope)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return nil, err
+	}
+	return nextLink(u, res.Header.Values(`Link`)), nil
+}
+
+// nextLink returns the target of the rel="next" link in "links", resolved
+// against "base".
+func nextLink(base *url.URL, links []string) *url.URL {
+	for _, h := range links {
+		for l := range strings.SplitSeq(h, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(l), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			if !strings.Contains(params, `rel="next"`) && !strings.Contains(params, `rel=next`) {
+				continue
+			}
+			u, err := base.Parse(target[1 : len(target)-1])
+			if err != nil {
+				continue
+			}
+			return u
+		}
+	}
+	return nil
+}
+
+// splitName splits a repository name into a [Repo], using the first path
+// component as the namespace.
+func splitName(name string) Repo {
+	ns, n, ok := strings.Cut(name, "/")
+	if !ok {
+		return Repo{Name: name}
+	}
+	return Repo{Namespace: ns, Name: n}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenRegistry serves a single manifest behind the bearer token flow. Its
+// tokens are valid until they expire or are revoked.
+type tokenRegistry struct {
+	// age is how long ago each token claims to have been issued.
+	age time.Duration
+
+	mu     sync.Mutex
+	valid  map[string]time.Time
+	issued int
+	denied int
+}
+
+func (f *tokenRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		f.issued++
+		tok := "tok" + strconv.Itoa(f.issued)
+		issued := time.Now().Add(-f.age)
+		f.valid[tok] = issued.Add(time.Minute)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":      tok,
+			"expires_in": 60,
+			"issued_at":  issued.Format(time.RFC3339),
+		})
+		return
+	}
+	tok, _ := strings.CutPrefix(r.Header.Get(`Authorization`), "Bearer ")
+	if exp, ok := f.valid[tok]; !ok || time.Now().After(exp) {
+		f.denied++
+		w.Header().Set(`WWW-Authenticate`, `Bearer realm="http://`+r.Host+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set(`Content-Type`, mediaTypeOCIManifest)
+	w.Write([]byte(`{"schemaVersion": 2, "layers": []}`))
+}
+
+// Revoke invalidates every token issued so far.
+func (f *tokenRegistry) Revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.valid)
+}
+
+// Counts reports how many tokens were issued and requests denied.
+func (f *tokenRegistry) Counts() (issued, denied int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued, f.denied
+}
+
+func TestRegistryToken(t *testing.T) {
+	tt := []struct {
+		Name string
+		Age  time.Duration
+		// Revoke invalidates the first token before the second request.
+		Revoke bool
+		// Issued and Denied are the tokens issued and requests denied over
+		// two requests.
+		Issued, Denied int
+	}{
+		{
+			Name:   "Cached",
+			Issued: 1,
+			Denied: 1,
+		},
+		{
+			Name:   "Revoked",
+			Revoke: true,
+			Issued: 2,
+			Denied: 2,
+		},
+		{
+			// Tokens are handed out with less than the leeway left, so the
+			// second request refreshes its token before sending it.
+			Name:   "Expiring",
+			Age:    time.Minute - tokenLeeway/2,
+			Issued: 2,
+			Denied: 1,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			f := &tokenRegistry{age: tc.Age, valid: make(map[string]time.Time)}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			reg, err := NewRegistry(srv.Client(), srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			for i := range 2 {
+				if i == 1 && tc.Revoke {
+					f.Revoke()
+				}
+				if _, _, err := reg.Manifest(ctx, "ns/repo", "latest"); err != nil {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+			}
+			issued, denied := f.Counts()
+			if issued != tc.Issued || denied != tc.Denied {
+				t.Errorf("issued, denied: got: %d, %d, want: %d, %d", issued, denied, tc.Issued, tc.Denied)
+			}
+		})
+	}
+}
+
+func TestPullAuth(t *testing.T) {
+	f := &tokenRegistry{valid: make(map[string]time.Time)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	reg, err := NewRegistry(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		// Spent is how much of the cached token's lifetime has passed.
+		Spent    time.Duration
+		Lifetime time.Duration
+		Want     string
+	}{
+		{0, time.Second, "Bearer tok1"},
+		// The cached token has enough time left.
+		{0, 30 * time.Second, "Bearer tok1"},
+		// The registry's tokens only last a minute, so a fresh one would be
+		// no better.
+		{0, 10 * time.Minute, "Bearer tok1"},
+		{20 * time.Second, 10 * time.Minute, "Bearer tok1"},
+		// Past half its lifetime, it's refreshed.
+		{40 * time.Second, 10 * time.Minute, "Bearer tok2"},
+		{0, 10 * time.Minute, "Bearer tok2"},
+	} {
+		reg.mu.Lock()
+		for scope, tok := range reg.tokens {
+			tok.Expires = tok.Expires.Add(-tc.Spent)
+			reg.tokens[scope] = tok
+		}
+		reg.mu.Unlock()
+		got, err := reg.PullAuth(ctx, "ns/repo", tc.Lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.Want {
+			t.Errorf("spent %v, lifetime %v: got: %q, want: %q", tc.Spent, tc.Lifetime, got, tc.Want)
+		}
+	}
+	if issued, _ := f.Counts(); issued != 2 {
+		t.Errorf("issued: got: %d, want: 2", issued)
+	}
+}
+
+// distribution is a registry with a paged catalog and tag lists, behind
+// either the bearer token flow or basic auth for the user "user".
+type distribution struct {
+	// basic challenges for basic auth instead of a bearer token.
+	basic bool
+	repos []string
+	tags  []string
+}
+
+func (f *distribution) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token": "tok"}`))
+		return
+	}
+	auth := r.Header.Get(`Authorization`)
+	switch {
+	case f.basic:
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.Header().Set(`WWW-Authenticate`, `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case auth != "Bearer tok":
+		w.Header().Set(`WWW-Authenticate`, `Bearer realm="http://`+r.Host+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Pages are two entries long, continuing after "last".
+	page := func(all []string, link func(last string) string) {
+		last := r.URL.Query().Get("last")
+		i := 0
+		if last != "" {
+			i = slices.Index(all, last) + 1
+		}
+		end := min(i+2, len(all))
+		if end < len(all) {
+			// Other links are mixed in, to check only "next" is followed.
+			w.Header().Add(`Link`, `</v2/>; rel="prev", <`+link(all[end-1])+`>; rel="next"`)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{
+			"repositories": all[i:end],
+			"tags":         all[i:end],
+		})
+	}
+	switch p := r.URL.Path; {
+	case p == "/v2/_catalog":
+		// The first link is relative, later ones absolute.
+		page(f.repos, func(last string) string {
+			u := &url.URL{Path: "/v2/_catalog", RawQuery: url.Values{"last": {last}, "n": {"2"}}.Encode()}
+			if r.URL.Query().Has("last") {
+				u.Scheme, u.Host = "http", r.Host
+			}
+			return u.String()
+		})
+	case strings.HasSuffix(p, "/tags/list"):
+		page(f.tags, func(last string) string {
+			return "list?" + url.Values{"last": {last}}.Encode()
+		})
+	case strings.Contains(p, "/manifests/") && r.Method == http.MethodHead:
+		ref := path.Base(p)
+		w.Header().Set(`Docker-Content-Digest`, "sha256:"+ref)
+		w.Header().Set(`Content-Type`, mediaTypeOCIManifest)
+		if ref == "list" {
+			w.Header().Set(`Content-Type`, mediaTypeOCIIndex)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRegistryPaging(t *testing.T) {
+	tt := []struct {
+		Name  string
+		Basic bool
+		Start int
+		Repos string
+	}{
+		{
+			Name:  "Bearer",
+			Start: 1,
+			Repos: "1:alpine 1:library/busybox 2:org/app 2:org/nested/image 3:zlib",
+		},
+		{
+			Name:  "Basic",
+			Basic: true,
+			Start: 1,
+			Repos: "1:alpine 1:library/busybox 2:org/app 2:org/nested/image 3:zlib",
+		},
+		{
+			// Earlier pages are walked to follow their links, but not
+			// yielded.
+			Name:  "Resume",
+			Start: 2,
+			Repos: "2:org/app 2:org/nested/image 3:zlib",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			f := &distribution{
+				basic: tc.Basic,
+				repos: []string{"alpine", "library/busybox", "org/app", "org/nested/image", "zlib"},
+				tags:  []string{"latest", "list", "v1"},
+			}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			reg, err := NewRegistry(srv.Client(), srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg.Auth = Credentials{Username: "user", Password: "pass"}
+			ctx := context.Background()
+
+			var repos []string
+			seq, check := reg.Repositories(ctx, tc.Start)
+			for pr := range seq {
+				repos = append(repos, fmt.Sprintf("%d:%s", pr.Page, path.Join(pr.Namespace, pr.Name)))
+			}
+			if err := check(); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(repos, " "); got != tc.Repos {
+				t.Errorf("repositories:\ngot:  %s\nwant: %s", got, tc.Repos)
+			}
+
+			var tags []string
+			tseq, check := reg.Tags(ctx, Repo{Namespace: "org", Name: "nested/image"})
+			for tag := range tseq {
+				tags = append(tags, fmt.Sprintf("%s@%s:%t", tag.Name, tag.Digest, tag.IsList))
+			}
+			if err := check(); err != nil {
+				t.Fatal(err)
+			}
+			want := "latest@sha256:latest:false list@sha256:list:true v1@sha256:v1:false"
+			if got := strings.Join(tags, " "); got != want {
+				t.Errorf("tags:\ngot:  %s\nwant: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	base, _ := url.Parse("https://registry.example/v2/_catalog?n=2")
+	tt := []struct {
+		Name  string
+		Links []string
+		Want  string
+	}{
+		{Name: "None"},
+		{
+			Name:  "Relative",
+			Links: []string{`</v2/_catalog?last=b&n=2>; rel="next"`},
+			Want:  "https://registry.example/v2/_catalog?last=b&n=2",
+		},
+		{
+			Name:  "Absolute",
+			Links: []string{`<https://other.example/v2/_catalog?last=b>; rel=next`},
+			Want:  "https://other.example/v2/_catalog?last=b",
+		},
+		{
+			Name:  "Several",
+			Links: []string{`</v2/_catalog?last=a>; rel="prev"`, `</v2/_catalog?last=c>; rel="prev", </v2/_catalog?last=d>; rel="next"`},
+			Want:  "https://registry.example/v2/_catalog?last=d",
+		},
+		{
+			Name:  "OnlyPrev",
+			Links: []string{`</v2/_catalog?last=a>; rel="prev"`},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var got string
+			if u := nextLink(base, tc.Links); u != nil {
+				got = u.String()
+			}
+			if got != tc.Want {
+				t.Errorf("got: %q, want: %q", got, tc.Want)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	got := parseChallenge(`realm="https://auth.example/token",service=registry.example, scope="repository:ns/repo:pull,push"`)
+	want := map[string]string{
+		"realm":   "https://auth.example/token",
+		"service": "registry.example",
+		"scope":   "repository:ns/repo:pull,push",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestRegistryIdentityToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			r.ParseForm()
+			if r.Method != http.MethodPost || r.PostForm.Get("grant_type") != "refresh_token" ||
+				r.PostForm.Get("refresh_token") != "refresh" || r.PostForm.Get("scope") != "repository:ns/repo:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token": "tok"}`))
+		case r.Header.Get(`Authorization`) != "Bearer tok":
+			w.Header().Set(`WWW-Authenticate`, `Bearer realm="http://`+r.Host+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Header().Set(`Content-Type`, mediaTypeOCIManifest)
+			w.Write([]byte(`{"schemaVersion": 2, "layers": []}`))
+		}
+	}))
+	defer srv.Close()
+	reg, err := NewRegistry(srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Auth = Credentials{Username: "someone", IdentityToken: "refresh"}
+	if _, err := reg.ImageManifest(context.Background(), "ns/repo", "latest"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryBlob(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	tt := []struct {
+		Name string
+		// HeaderDelay and BodyDelay are how long the server waits before
+		// sending the response headers and the rest of the body.
+		HeaderDelay, BodyDelay time.Duration
+		Err                    bool
+	}{
+		{
+			Name: "Fast",
+		},
+		{
+			// Reading the body takes longer than the timeout, which is fine
+			// for a large layer.
+			Name:      "SlowBody",
+			BodyDelay: 4 * timeout,
+		},
+		{
+			Name:        "SlowHeaders",
+			HeaderDelay: 4 * timeout,
+			Err:         true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tc.HeaderDelay)
+				w.Write([]byte("first "))
+				w.(http.Flusher).Flush()
+				time.Sleep(tc.BodyDelay)
+				w.Write([]byte("second"))
+			}))
+			defer srv.Close()
+			// The crawl client would give up on the slow body.
+			hc := &http.Client{Transport: &retryTransport{Attempts: 1, Timeout: timeout}}
+			reg, err := NewRegistry(hc, srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg.Blobs = blobClient(1, timeout)
+
+			rc, err := reg.Blob(context.Background(), "ns/repo", "sha256:layer")
+			if err == nil {
+				var b []byte
+				b, err = io.ReadAll(rc)
+				rc.Close()
+				if err == nil && string(b) != "first second" {
+					t.Errorf("body: got: %q", b)
+				}
+			}
+			if got := err != nil; got != tc.Err {
+				t.Errorf("error: got: %v, want error: %v", err, tc.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// retryTransport is an [http.RoundTripper] that retries requests that fail
+// with a transient network error or a status that indicates the server may
+// succeed later (429 and 5xx).
+//
+// Retries back off exponentially with full jitter, unless the server sends a
+// Retry-After header, which is honored.
+type retryTransport struct {
+	// Next is the underlying transport. If nil, [http.DefaultTransport] is
+	// used.
+	Next http.RoundTripper
+	// Attempts is the total number of attempts made for a request.
+	Attempts int
+	// Timeout bounds every attempt, including reading the response body. If
+	// zero, attempts are bounded only by the request's context.
+	Timeout time.Duration
+	// Base and Max bound the backoff between attempts.
+	Base, Max time.Duration
+}
+
+// RoundTrip implements [http.RoundTripper].
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	ctx := req.Context()
+	attempts := max(t.Attempts, 1)
+	// A request body can only be replayed if it can be rewound.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		attempts = 1
+	}
+
+	for n := 1; ; n++ {
+		r, cancel, err := t.attempt(req)
+		if err != nil {
+			return nil, err
+		}
+		res, err := next.RoundTrip(r)
+		if n >= attempts || !retryable(res, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+
+		wait := t.backoff(n)
+		l := slog.With("url", req.URL.String(), "attempt", n, "limit", attempts)
+		if err != nil {
+			l = l.With("reason", err)
+		} else {
+			l = l.With("status", res.Status)
+			if d, ok := retryAfter(res); ok {
+				wait = d
+			}
+			// Drain some of the body so the connection can be reused.
+			io.CopyN(io.Discard, res.Body, 4096)
+			res.Body.Close()
+		}
+		cancel()
+		l.InfoContext(ctx, "retrying request", "wait", wait)
+
+		tm := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			tm.Stop()
+			return nil, context.Cause(ctx)
+		case <-tm.C:
+		}
+	}
+}
+
+// attempt returns a copy of "req" for a single attempt, with a fresh body and
+// the per-attempt timeout applied.
+func (t *retryTransport) attempt(req *http.Request) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+	}
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		r.Body = b
+	}
+	return r, cancel, nil
+}
+
+// backoff reports how long to wait after attempt "n" failed.
+func (t *retryTransport) backoff(n int) time.Duration {
+	base, ceil := t.Base, t.Max
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	if ceil <= 0 {
+		ceil = time.Minute
+	}
+	d := ceil
+	if n < 32 {
+		d = min(ceil, base<<(n-1))
+	}
+	return rand.N(d) + 1
+}
+
+// retryable reports whether the outcome of a round trip is worth retrying.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, context.Canceled):
+			return false
+		case errors.Is(err, context.DeadlineExceeded):
+			// This is the per-attempt timeout if the parent context is still
+			// live; the caller checks the parent separately.
+			return true
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return true
+		case errors.Is(err, io.ErrUnexpectedEOF),
+			errors.Is(err, io.EOF),
+			errors.Is(err, syscall.ECONNRESET),
+			errors.Is(err, syscall.ECONNREFUSED):
+			return true
+		}
+		return false
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// blobClient returns a client for downloading blobs. A layer can be large
+// enough that reading it takes longer than "timeout", so only the wait for the
+// response headers is bounded, not the whole attempt.
+func blobClient(attempts int, timeout time.Duration) *http.Client {
+	next := http.DefaultTransport.(*http.Transport).Clone()
+	next.ResponseHeaderTimeout = timeout
+	return &http.Client{
+		Transport: &retryTransport{
+			Next:     next,
+			Attempts: attempts,
+		},
+	}
+}
+
+// retryAfter parses the Retry-After header of "res", if present.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	v := res.Header.Get(`Retry-After`)
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(s, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// cancelBody releases an attempt's context when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
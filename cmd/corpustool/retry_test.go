@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tt := []struct {
+		Name     string
+		Statuses []int
+		Want     int
+		Calls    int32
+	}{
+		{
+			Name:     "OK",
+			Statuses: []int{http.StatusOK},
+			Want:     http.StatusOK,
+			Calls:    1,
+		},
+		{
+			Name:     "TooManyRequests",
+			Statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK},
+			Want:     http.StatusOK,
+			Calls:    3,
+		},
+		{
+			Name:     "BadGateway",
+			Statuses: []int{http.StatusBadGateway, http.StatusOK},
+			Want:     http.StatusOK,
+			Calls:    2,
+		},
+		{
+			Name:     "NotFound",
+			Statuses: []int{http.StatusNotFound, http.StatusOK},
+			Want:     http.StatusNotFound,
+			Calls:    1,
+		},
+		{
+			Name:     "Exhausted",
+			Statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			Want:     http.StatusServiceUnavailable,
+			Calls:    3,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				code := tc.Statuses[n-1]
+				if code == http.StatusTooManyRequests {
+					w.Header().Set(`Retry-After`, `0`)
+				}
+				w.WriteHeader(code)
+				io.WriteString(w, r.URL.Path)
+			}))
+			t.Cleanup(srv.Close)
+
+			c := &http.Client{
+				Transport: &retryTransport{
+					Attempts: 3,
+					Timeout:  time.Second,
+					Base:     time.Millisecond,
+				},
+			}
+			res, err := c.Get(srv.URL + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := res.StatusCode, tc.Want; got != want {
+				t.Errorf("status: got: %d, want: %d", got, want)
+			}
+			if got, want := calls.Load(), tc.Calls; got != want {
+				t.Errorf("calls: got: %d, want: %d", got, want)
+			}
+			if got, want := string(b), "/test"; got != want {
+				t.Errorf("body: got: %q, want: %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRetryTransportBody(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if string(b) != "payload" {
+			t.Errorf("body: got: %q", string(b))
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := &http.Client{
+		Transport: &retryTransport{
+			Attempts: 3,
+			Base:     time.Millisecond,
+		},
+	}
+	res, err := c.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusCreated; got != want {
+		t.Errorf("status: got: %d, want: %d", got, want)
+	}
+}
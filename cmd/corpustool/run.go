@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Run outcomes, as stored in the crawl_run table.
+const (
+	outcomeSuccess     = "success"
+	outcomeInterrupted = "interrupted"
+	outcomeError       = "error"
+)
+
+// RunOptions is the record of the options a crawl run was started with. It
+// deliberately leaves out credentials.
+type RunOptions struct {
+	Count             int      `json:"count"`
+	MaxAge            string   `json:"max_age"`
+	Restart           bool     `json:"restart"`
+	Resolve           bool     `json:"resolve"`
+	Layers            bool     `json:"layers"`
+	OSRelease         bool     `json:"os_release,omitempty"`
+	Lister            string   `json:"lister"`
+	Query             string   `json:"query"`
+	Shard             bool     `json:"shard,omitempty"`
+	Namespaces        []string `json:"namespaces,omitempty"`
+	ExcludeNamespaces []string `json:"exclude_namespaces,omitempty"`
+	Repository        string   `json:"repository,omitempty"`
+	Tag               string   `json:"tag,omitempty"`
+	ModifiedWithin    string   `json:"modified_within,omitempty"`
+	SkipExpiring      bool     `json:"skip_expiring,omitempty"`
+	ManifestKind      string   `json:"manifest_kind,omitempty"`
+	Authenticated     bool     `json:"authenticated"`
+	ErrorBudget       string   `json:"error_budget"`
+	RetryFailed       bool     `json:"retry_failed,omitempty"`
+}
+
+func newRunOptions(opts *Options) RunOptions {
+	ro := RunOptions{
+		Count:             opts.Count,
+		MaxAge:            opts.MaxAge.String(),
+		Restart:           opts.Restart,
+		Resolve:           opts.Resolve,
+		Layers:            opts.Layers,
+		OSRelease:         opts.OSRelease,
+		Lister:            opts.Lister,
+		Query:             opts.Query,
+		Shard:             opts.Shard,
+		Namespaces:        opts.Filter.Namespaces,
+		ExcludeNamespaces: opts.Filter.ExcludeNamespaces,
+		Authenticated:     opts.Auth != Credentials{},
+		ErrorBudget:       opts.Budget.String(),
+		RetryFailed:       opts.RetryFailed,
+	}
+	if re := opts.Filter.Repository; re != nil {
+		ro.Repository = re.String()
+	}
+	if re := opts.Filter.Tag; re != nil {
+		ro.Tag = re.String()
+	}
+	if d := opts.Filter.ModifiedWithin; d != 0 {
+		ro.ModifiedWithin = d.String()
+	}
+	ro.SkipExpiring = opts.Filter.SkipExpiring
+	ro.ManifestKind = opts.Filter.ManifestKind
+	return ro
+}
+
+// buildVersion reports the version of this binary from its build info: the
+// module version if there is one, otherwise the VCS revision.
+func buildVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev string
+	var dirty bool
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if rev == "" {
+		return "(devel)"
+	}
+	if dirty {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// startRun records a new crawl run of the registry "regID" through the API at
+// "apiRoot" and returns its ID.
+func startRun(conn *sqlite.Conn, regID int64, apiRoot string, opts *Options) (id int64, err error) {
+	b, err := json.Marshal(newRunOptions(opts))
+	if err != nil {
+		return 0, err
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "insert_crawl_run.sql", &sqlitex.ExecOptions{
+		Args: []any{regID, apiRoot, buildVersion(), string(b)},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	return id, err
+}
+
+// finishRun records how the crawl run "id" ended, and whether it listed every
+// repository. "ctx" is the context the crawl was started with, used to tell an
+// interrupted crawl from a failed one.
+func finishRun(ctx context.Context, conn *sqlite.Conn, id int64, repositories, failed int, complete bool, crawlErr error) error {
+	outcome, msg := outcomeSuccess, ""
+	switch {
+	case crawlErr == nil:
+	case ctx.Err() != nil:
+		outcome, msg = outcomeInterrupted, context.Cause(ctx).Error()
+	default:
+		outcome, msg = outcomeError, crawlErr.Error()
+	}
+	return sqlitex.ExecuteFS(conn, sql.FS, "finish_crawl_run.sql", &sqlitex.ExecOptions{
+		Args: []any{id, repositories, failed, outcome, msg, complete},
+	})
+}
+
+// RunInfo is the bookkeeping for one crawl run.
+type RunInfo struct {
+	ID       int64      `json:"id"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Registry string     `json:"registry,omitempty"`
+	APIRoot  string     `json:"api_root,omitempty"`
+	Version  string     `json:"version,omitempty"`
+	// Options is the JSON form of [RunOptions].
+	Options      json.RawMessage `json:"options,omitempty"`
+	Repositories int             `json:"repositories"`
+	Failed       int             `json:"failed"`
+	Tags         int             `json:"tags"`
+	// Outcome is empty if the run has not finished, or was recorded before
+	// runs were tracked.
+	Outcome string `json:"outcome,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// loadRuns reads every crawl run in the database, oldest first.
+func loadRuns(conn *sqlite.Conn) ([]RunInfo, error) {
+	var out []RunInfo
+	err := sqlitex.ExecuteFS(conn, sql.FS, "get_run_info.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			r := RunInfo{
+				ID:           stmt.ColumnInt64(0),
+				Started:      time.Unix(stmt.ColumnInt64(1), 0).UTC(),
+				Registry:     stmt.ColumnText(3),
+				APIRoot:      stmt.ColumnText(4),
+				Version:      stmt.ColumnText(5),
+				Repositories: stmt.ColumnInt(7),
+				Tags:         stmt.ColumnInt(8),
+				Outcome:      stmt.ColumnText(9),
+				Message:      stmt.ColumnText(10),
+				Failed:       stmt.ColumnInt(11),
+			}
+			if stmt.ColumnType(2) != sqlite.TypeNull {
+				t := time.Unix(stmt.ColumnInt64(2), 0).UTC()
+				r.Finished = &t
+			}
+			if o := stmt.ColumnText(6); o != "" {
+				r.Options = json.RawMessage(o)
+			}
+			out = append(out, r)
+			return nil
+		},
+	})
+	return out, err
+}
+
+// runsMain lists the crawl runs recorded in the database "db".
+func runsMain(ctx context.Context, db string, args []string) error {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s runs [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "output format: text or json")
+	fs.Parse(args)
+	switch *format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown format: %q", *format)
+	}
+
+	conn, err := openReadOnly(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	runs, err := loadRuns(conn)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := writeRuns(w, *format, runs); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func writeRuns(w io.Writer, format string, runs []RunInfo) error {
+	if format == "json" {
+		if runs == nil {
+			runs = []RunInfo{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(runs)
+	}
+	for _, r := range runs {
+		outcome := r.Outcome
+		if outcome == "" {
+			outcome = "unfinished"
+		}
+		out := fmt.Sprintf("run %d: %s, started %s", r.ID, outcome, r.Started.Format(time.RFC3339))
+		if r.Finished != nil {
+			out += fmt.Sprintf(", took %s", r.Finished.Sub(r.Started))
+		}
+		out += fmt.Sprintf(", %d repositories, %d failed, %d tags\n", r.Repositories, r.Failed, r.Tags)
+		if r.APIRoot != "" {
+			out += fmt.Sprintf("\tapi root: %s\n\tversion: %s\n\toptions: %s\n", r.APIRoot, r.Version, r.Options)
+		}
+		if r.Message != "" {
+			out += fmt.Sprintf("\tmessage: %s\n", r.Message)
+		}
+		if _, err := io.WriteString(w, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"maps"
+	"math/rand/v2"
+	"slices"
+)
+
+// SampleOptions is the configuration for the "sample" subcommand.
+type SampleOptions struct {
+	// N is the number of refs to select.
+	N int
+	// Seed seeds the random selection. The same seed and database always
+	// produce the same sample.
+	Seed uint64
+	// PerRepository, if positive, is the maximum number of tags selected from
+	// any one repository.
+	PerRepository int
+	// PerNamespace, if positive, is the maximum number of repositories
+	// selected from any one namespace.
+	PerNamespace int
+	// Proportional allocates the sample across namespaces in proportion to
+	// their size, instead of evenly.
+	Proportional bool
+	// PerRelease selects N refs from each distribution release, instead of
+	// N overall. Refs of unknown distribution are left out.
+	PerRelease bool
+
+	// Format, Output, ByDigest, Registry, and Filter are as for
+	// [ExportOptions].
+	Format   string
+	Output   string
+	ByDigest bool
+	Registry string
+	Filter   Filter
+}
+
+// sampleMain parses the "sample" subcommand's flags from "args" and runs it
+// against the database "db".
+func sampleMain(ctx context.Context, db string, args []string) error {
+	var opts SampleOptions
+	fs := flag.NewFlagSet("sample", flag.ExitOnError)
+	fs.IntVar(&opts.N, "n", 100, "number of refs to select")
+	fs.Uint64Var(&opts.Seed, "seed", 1, "random seed")
+	fs.IntVar(&opts.PerRepository, "per-repository", 1, "select at most `K` tags per repository (0 for no limit)")
+	fs.IntVar(&opts.PerNamespace, "per-namespace", 0, "select at most `M` repositories per namespace (0 for no limit)")
+	fs.BoolVar(&opts.Proportional, "proportional", false, "sample namespaces in proportion to their size instead of evenly")
+	fs.BoolVar(&opts.PerRelease, "per-release", false, "select -n refs from each distribution release instead of overall")
+	fs.StringVar(&opts.Format, "format", "text", "output format: text, jsonl, or csv")
+	fs.StringVar(&opts.Output, "o", "-", "write to `file` instead of stdout")
+	fs.BoolVar(&opts.ByDigest, "digest", false, "write references by digest in the text format")
+	fs.StringVar(&opts.Registry, "registry", "", "only sample refs from registry `host`")
+	fs.Var((*listFlag)(&opts.Filter.Namespaces), "namespace", "only sample these namespaces (comma-separated, repeatable)")
+	fs.Var((*listFlag)(&opts.Filter.ExcludeNamespaces), "exclude-namespace", "skip these namespaces (comma-separated, repeatable)")
+	fs.Func("repository", "only sample repositories whose \"namespace/name\" matches `regexp`", regexpFlag(&opts.Filter.Repository))
+	fs.Func("tag", "only sample tags matching `regexp`", regexpFlag(&opts.Filter.Tag))
+	fs.BoolVar(&opts.Filter.PublicOnly, "public", false, "only sample public repositories")
+	fs.StringVar(&opts.Filter.NamespaceKind, "namespace-kind", "", "only sample namespaces of this `kind`: user or organization")
+	fs.Float64Var(&opts.Filter.MinPopularity, "min-popularity", 0, "only sample repositories with at least this popularity")
+	fs.Var((*listFlag)(&opts.Filter.Distros), "distro", "only sample images of these distributions, as `id[:version]` (comma-separated, repeatable)")
+	fs.Parse(args)
+	return Sample(ctx, db, opts)
+}
+
+// Sample writes a random sample of the refs in the database "db" according to
+// "opts".
+func Sample(ctx context.Context, db string, opts SampleOptions) error {
+	if err := checkFormat(opts.Format); err != nil {
+		return err
+	}
+	conn, err := openReadOnly(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		return err
+	}
+	refs = filterRefs(refs, opts.Registry, &opts.Filter)
+	if opts.PerRelease {
+		refs = sampleByRelease(refs, &opts)
+	} else {
+		refs = sampleRefs(refs, &opts)
+	}
+	return writeOutput(opts.Output, opts.Format, opts.ByDigest, refs)
+}
+
+// sampleByRelease selects the sample described by "opts" from each
+// distribution release in "refs" separately. The result is sorted by
+// reference.
+func sampleByRelease(refs []Ref, opts *SampleOptions) []Ref {
+	groups := make(map[string][]Ref)
+	for _, r := range refs {
+		if r.Distro == "" {
+			continue
+		}
+		k := r.Distro + ":" + r.DistroVersion
+		groups[k] = append(groups[k], r)
+	}
+	var out []Ref
+	for _, k := range slices.Sorted(maps.Keys(groups)) {
+		out = append(out, sampleRefs(groups[k], opts)...)
+	}
+	slices.SortFunc(out, func(a, b Ref) int {
+		return cmp.Compare(a.TagRef(), b.TagRef())
+	})
+	return out
+}
+
+// sampleRefs selects the sample described by "opts" from "refs", which must
+// be in a deterministic order. The result is sorted by reference.
+func sampleRefs(refs []Ref, opts *SampleOptions) []Ref {
+	rng := rand.New(rand.NewPCG(opts.Seed, 0))
+
+	// Group into namespaces of repositories of tags, preserving the input
+	// order so that the shuffles below are reproducible.
+	type repo struct {
+		name string
+		tags []Ref
+	}
+	type namespace struct {
+		key   string
+		repos []*repo
+		pool  []Ref
+	}
+	var nss []*namespace
+	nsIdx := make(map[string]*namespace)
+	repoIdx := make(map[string]*repo)
+	for _, r := range refs {
+		nk := r.Registry + "/" + r.Namespace
+		ns, ok := nsIdx[nk]
+		if !ok {
+			ns = &namespace{key: nk}
+			nsIdx[nk] = ns
+			nss = append(nss, ns)
+		}
+		rk := r.Name()
+		rp, ok := repoIdx[rk]
+		if !ok {
+			rp = &repo{name: rk}
+			repoIdx[rk] = rp
+			ns.repos = append(ns.repos, rp)
+		}
+		rp.tags = append(rp.tags, r)
+	}
+
+	// Apply the per-repository and per-namespace limits, then build each
+	// namespace's candidate pool by dealing tags out of its repositories
+	// round-robin, so repositories are exhausted evenly.
+	total := 0
+	for _, ns := range nss {
+		rng.Shuffle(len(ns.repos), func(i, j int) {
+			ns.repos[i], ns.repos[j] = ns.repos[j], ns.repos[i]
+		})
+		if opts.PerNamespace > 0 && len(ns.repos) > opts.PerNamespace {
+			ns.repos = ns.repos[:opts.PerNamespace]
+		}
+		for _, rp := range ns.repos {
+			rng.Shuffle(len(rp.tags), func(i, j int) {
+				rp.tags[i], rp.tags[j] = rp.tags[j], rp.tags[i]
+			})
+			if opts.PerRepository > 0 && len(rp.tags) > opts.PerRepository {
+				rp.tags = rp.tags[:opts.PerRepository]
+			}
+		}
+		for i := 0; ; i++ {
+			added := false
+			for _, rp := range ns.repos {
+				if i < len(rp.tags) {
+					ns.pool = append(ns.pool, rp.tags[i])
+					added = true
+				}
+			}
+			if !added {
+				break
+			}
+		}
+		total += len(ns.pool)
+	}
+	rng.Shuffle(len(nss), func(i, j int) {
+		nss[i], nss[j] = nss[j], nss[i]
+	})
+
+	n := min(opts.N, total)
+	out := make([]Ref, 0, n)
+	switch {
+	case opts.Proportional && total > 0:
+		// Largest remainder allocation.
+		quota := make([]int, len(nss))
+		rem := make([]int, len(nss))
+		alloc := 0
+		for i, ns := range nss {
+			quota[i] = n * len(ns.pool) / total
+			rem[i] = n * len(ns.pool) % total
+			alloc += quota[i]
+		}
+		order := make([]int, len(nss))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			return cmp.Compare(rem[b], rem[a])
+		})
+		for _, i := range order[:n-alloc] {
+			quota[i]++
+		}
+		for i, ns := range nss {
+			out = append(out, ns.pool[:quota[i]]...)
+		}
+	default:
+		// Deal out of the namespaces round-robin.
+		for i := 0; len(out) < n; i++ {
+			for _, ns := range nss {
+				if i < len(ns.pool) && len(out) < n {
+					out = append(out, ns.pool[i])
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(out, func(a, b Ref) int {
+		return cmp.Compare(a.TagRef(), b.TagRef())
+	})
+	return out
+}
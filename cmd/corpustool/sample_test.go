@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// testCorpus returns a corpus where namespace "big" dwarfs the others.
+func testCorpus() []Ref {
+	var refs []Ref
+	add := func(ns string, repos, tags int) {
+		for r := range repos {
+			for t := range tags {
+				refs = append(refs, Ref{
+					Registry:   "quay.io",
+					Namespace:  ns,
+					Repository: fmt.Sprintf("repo%02d", r),
+					Tag:        fmt.Sprintf("v%02d", t),
+				})
+			}
+		}
+	}
+	add("big", 40, 5)
+	add("medium", 10, 2)
+	add("small", 2, 2)
+	return refs
+}
+
+func countBy(refs []Ref, key func(Ref) string) map[string]int {
+	out := make(map[string]int)
+	for _, r := range refs {
+		out[key(r)]++
+	}
+	return out
+}
+
+func TestSample(t *testing.T) {
+	t.Run("Deterministic", func(t *testing.T) {
+		opts := SampleOptions{N: 20, Seed: 7, PerRepository: 2}
+		a := sampleRefs(testCorpus(), &opts)
+		b := sampleRefs(testCorpus(), &opts)
+		if !slices.Equal(a, b) {
+			t.Error("same seed produced different samples")
+		}
+		opts.Seed++
+		c := sampleRefs(testCorpus(), &opts)
+		if slices.Equal(a, c) {
+			t.Error("different seeds produced the same sample")
+		}
+	})
+	t.Run("PerRepository", func(t *testing.T) {
+		opts := SampleOptions{N: 1000, Seed: 1, PerRepository: 1}
+		got := sampleRefs(testCorpus(), &opts)
+		if got, want := len(got), 52; got != want {
+			t.Errorf("got: %d refs, want: %d", got, want)
+		}
+		for k, v := range countBy(got, func(r Ref) string { return r.Name() }) {
+			if v != 1 {
+				t.Errorf("%s: got: %d tags, want: 1", k, v)
+			}
+		}
+	})
+	t.Run("PerNamespace", func(t *testing.T) {
+		opts := SampleOptions{N: 1000, Seed: 1, PerNamespace: 3, PerRepository: 1}
+		got := countBy(sampleRefs(testCorpus(), &opts), func(r Ref) string { return r.Namespace })
+		want := map[string]int{"big": 3, "medium": 3, "small": 2}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: got: %d, want: %d", k, got[k], v)
+			}
+		}
+	})
+	t.Run("Even", func(t *testing.T) {
+		opts := SampleOptions{N: 12, Seed: 1}
+		got := countBy(sampleRefs(testCorpus(), &opts), func(r Ref) string { return r.Namespace })
+		want := map[string]int{"big": 4, "medium": 4, "small": 4}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: got: %d, want: %d", k, got[k], v)
+			}
+		}
+	})
+	t.Run("PerRelease", func(t *testing.T) {
+		refs := testCorpus()
+		for i := range refs {
+			switch i % 3 {
+			case 0:
+				refs[i].Distro, refs[i].DistroVersion = "rhel", "9.4"
+			case 1:
+				refs[i].Distro, refs[i].DistroVersion = "alpine", "3.20.1"
+			}
+		}
+		opts := SampleOptions{N: 5, Seed: 1, PerRelease: true}
+		got := countBy(sampleByRelease(refs, &opts), func(r Ref) string { return r.Distro })
+		want := map[string]int{"rhel": 5, "alpine": 5, "": 0}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%q: got: %d, want: %d", k, got[k], v)
+			}
+		}
+	})
+	t.Run("Proportional", func(t *testing.T) {
+		opts := SampleOptions{N: 20, Seed: 1, Proportional: true}
+		got := countBy(sampleRefs(testCorpus(), &opts), func(r Ref) string { return r.Namespace })
+		// 200, 20, and 4 tags.
+		want := map[string]int{"big": 18, "medium": 2, "small": 0}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: got: %d, want: %d", k, got[k], v)
+			}
+		}
+	})
+}
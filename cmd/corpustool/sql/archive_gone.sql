@@ -0,0 +1,31 @@
+INSERT INTO
+  repo_tag_archive (
+    registry,
+    namespace,
+    repository,
+    tag,
+    digest,
+    first_seen,
+    last_seen,
+    gone,
+    archived
+  )
+SELECT
+  h.host,
+  n.value,
+  r.value,
+  t.value,
+  m.digest,
+  repo_tag.first_seen,
+  repo_tag.last_seen,
+  repo_tag.gone,
+  unixepoch()
+FROM
+  repo_tag
+  JOIN registry AS h ON (repo_tag.registry = h.id)
+  JOIN namespace_name AS n ON (repo_tag.namespace = n.id)
+  JOIN repository_name AS r ON (repo_tag.repository = r.id)
+  JOIN tag_name AS t ON (repo_tag.tag = t.id)
+  LEFT JOIN manifest AS m ON (repo_tag.manifest = m.id)
+WHERE
+  repo_tag.gone <= ?;
@@ -0,0 +1,4 @@
+DELETE FROM crawl_state
+WHERE
+  registry = ?
+  AND query = ?;
@@ -0,0 +1,13 @@
+INSERT OR IGNORE INTO
+  run_tag (run, repo_tag, manifest)
+SELECT
+  ?1,
+  id,
+  manifest
+FROM
+  repo_tag
+WHERE
+  registry = ?2
+  AND namespace = ?3
+  AND repository = ?4
+  AND gone IS NULL;
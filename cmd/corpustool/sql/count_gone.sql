@@ -0,0 +1,17 @@
+SELECT
+  (
+    SELECT
+      count(*)
+    FROM
+      repo_tag
+    WHERE
+      gone <= ?1
+  ),
+  (
+    SELECT
+      count(*)
+    FROM
+      repository_seen
+    WHERE
+      gone <= ?1
+  );
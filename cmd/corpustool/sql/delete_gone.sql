@@ -0,0 +1,46 @@
+DELETE FROM run_tag
+WHERE
+  repo_tag IN (
+    SELECT
+      id
+    FROM
+      repo_tag
+    WHERE
+      gone <= :before
+  );
+
+DELETE FROM repo_tag
+WHERE
+  gone <= :before;
+
+-- A repository's fetch time and failures go with it, so that it's fetched
+-- afresh if it comes back.
+DELETE FROM repository_fetch
+WHERE
+  (registry, namespace, repository) IN (
+    SELECT
+      registry,
+      namespace,
+      repository
+    FROM
+      repository_seen
+    WHERE
+      gone <= :before
+  );
+
+DELETE FROM fetch_error
+WHERE
+  (registry, namespace, repository) IN (
+    SELECT
+      registry,
+      namespace,
+      repository
+    FROM
+      repository_seen
+    WHERE
+      gone <= :before
+  );
+
+DELETE FROM repository_seen
+WHERE
+  gone <= :before;
@@ -0,0 +1,39 @@
+SELECT
+  h.host,
+  n.value,
+  r.value,
+  t.value,
+  coalesce(m.digest, ''),
+  s.description,
+  s.is_public,
+  s.kind,
+  s.popularity,
+  s.last_modified,
+  nm.kind,
+  mr.distro,
+  mr.version
+FROM
+  run_tag
+  JOIN repo_tag ON (run_tag.repo_tag = repo_tag.id)
+  JOIN registry AS h ON (repo_tag.registry = h.id)
+  JOIN namespace_name AS n ON (repo_tag.namespace = n.id)
+  JOIN repository_name AS r ON (repo_tag.repository = r.id)
+  JOIN tag_name AS t ON (repo_tag.tag = t.id)
+  LEFT JOIN manifest AS m ON (run_tag.manifest = m.id)
+  LEFT JOIN manifest_release AS mr ON (m.id = mr.manifest)
+  LEFT JOIN repository_seen AS s ON (
+    repo_tag.registry = s.registry
+    AND repo_tag.namespace = s.namespace
+    AND repo_tag.repository = s.repository
+  )
+  LEFT JOIN namespace_meta AS nm ON (
+    repo_tag.registry = nm.registry
+    AND repo_tag.namespace = nm.namespace
+  )
+WHERE
+  run_tag.run = ?
+ORDER BY
+  h.host,
+  n.value,
+  r.value,
+  t.value;
@@ -0,0 +1,18 @@
+UPDATE crawl_run
+SET
+  finished = unixepoch(),
+  repositories = ?2,
+  failed = ?3,
+  tags = (
+    SELECT
+      count(*)
+    FROM
+      run_tag
+    WHERE
+      run = ?1
+  ),
+  outcome = ?4,
+  message = ?5,
+  complete = ?6
+WHERE
+  id = ?1;
@@ -0,0 +1,5 @@
+UPDATE report_run
+SET
+  finished = unixepoch()
+WHERE
+  id = ?;
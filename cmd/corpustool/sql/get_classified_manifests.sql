@@ -0,0 +1,9 @@
+SELECT
+  m.digest,
+  coalesce(l.digest, ''),
+  d.distro,
+  d.version
+FROM
+  image_distro AS d
+  JOIN manifest AS m ON (d.manifest = m.id)
+  LEFT JOIN layer AS l ON (d.layer = l.id);
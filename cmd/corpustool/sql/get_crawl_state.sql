@@ -0,0 +1,8 @@
+SELECT
+  page,
+  coalesce(pass_run, 0)
+FROM
+  crawl_state
+WHERE
+  registry = ?
+  AND query = ?;
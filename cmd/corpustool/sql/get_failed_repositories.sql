@@ -0,0 +1,13 @@
+SELECT DISTINCT
+  n.value,
+  r.value
+FROM
+  fetch_error AS e
+  JOIN namespace_name AS n ON (e.namespace = n.id)
+  JOIN repository_name AS r ON (e.repository = r.id)
+WHERE
+  e.registry = ?
+  AND e.resolved IS NULL
+ORDER BY
+  n.value,
+  r.value;
@@ -0,0 +1,10 @@
+SELECT
+  n.value,
+  r.value,
+  f.fetched
+FROM
+  repository_fetch AS f
+  JOIN namespace_name AS n ON (f.namespace = n.id)
+  JOIN repository_name AS r ON (f.repository = r.id)
+WHERE
+  f.registry = ?;
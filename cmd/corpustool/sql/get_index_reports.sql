@@ -0,0 +1,8 @@
+SELECT
+  m.digest,
+  coalesce(r.state, '')
+FROM
+  index_report AS r
+  JOIN manifest AS m ON (r.manifest = m.id)
+WHERE
+  r.indexer = ?;
@@ -0,0 +1,10 @@
+SELECT
+  m.digest
+FROM
+  index_report AS r
+  JOIN manifest AS m ON (r.manifest = m.id)
+WHERE
+  r.indexer = ?
+  AND r.state = 'IndexFinished'
+ORDER BY
+  m.digest;
@@ -0,0 +1,6 @@
+SELECT
+  digest
+FROM
+  manifest
+WHERE
+  config IS NOT NULL;
@@ -0,0 +1,15 @@
+SELECT
+  p.digest,
+  c.digest,
+  mc.os,
+  mc.architecture,
+  mc.variant
+FROM
+  manifest_child AS mc
+  JOIN manifest AS p ON (mc.parent = p.id)
+  JOIN manifest AS c ON (mc.child = c.id)
+WHERE
+  NOT c.is_list
+ORDER BY
+  p.digest,
+  c.digest;
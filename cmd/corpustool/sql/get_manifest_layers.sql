@@ -0,0 +1,11 @@
+SELECT
+  m.digest,
+  l.digest,
+  l.size
+FROM
+  manifest_layer AS ml
+  JOIN manifest AS m ON (ml.manifest = m.id)
+  JOIN layer AS l ON (ml.layer = l.id)
+ORDER BY
+  ml.manifest,
+  ml.idx;
@@ -1,6 +0,0 @@
-SELECT
-  id
-FROM
-  namespace_name
-WHERE
-  value = ?;
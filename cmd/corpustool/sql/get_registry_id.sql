@@ -0,0 +1,6 @@
+SELECT
+  id
+FROM
+  registry
+WHERE
+  host = ?;
@@ -0,0 +1,10 @@
+SELECT
+  p.package
+FROM
+  report_package AS p
+  JOIN manifest AS m ON (p.manifest = m.id)
+WHERE
+  p.run = ?
+  AND m.digest = ?
+ORDER BY
+  p.package;
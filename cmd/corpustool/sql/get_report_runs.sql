@@ -0,0 +1,8 @@
+SELECT
+  id,
+  matcher,
+  label
+FROM
+  report_run
+ORDER BY
+  id DESC;
@@ -0,0 +1,16 @@
+SELECT
+  v.vulnerability,
+  v.package,
+  v.fixed_in_version,
+  v.severity
+FROM
+  report_vulnerability AS v
+  JOIN manifest AS m ON (v.manifest = m.id)
+WHERE
+  v.run = ?
+  AND m.digest = ?
+ORDER BY
+  v.vulnerability,
+  v.package,
+  v.fixed_in_version,
+  v.severity;
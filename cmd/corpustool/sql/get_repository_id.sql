@@ -1,6 +0,0 @@
-SELECT
-  id
-FROM
-  repository_name
-WHERE
-  value = ?;
@@ -0,0 +1,8 @@
+SELECT
+  p.digest,
+  m.digest,
+  m.is_list
+FROM
+  manifest_child AS c
+  JOIN manifest AS p ON (c.parent = p.id)
+  JOIN manifest AS m ON (c.child = m.id);
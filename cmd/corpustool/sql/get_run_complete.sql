@@ -0,0 +1,6 @@
+SELECT
+  complete
+FROM
+  crawl_run
+WHERE
+  id = ?;
@@ -0,0 +1,18 @@
+SELECT
+  c.id,
+  c.started,
+  c.finished,
+  r.host,
+  c.api_root,
+  c.version,
+  c.options,
+  c.repositories,
+  c.tags,
+  c.outcome,
+  c.message,
+  c.failed
+FROM
+  crawl_run AS c
+  LEFT JOIN registry AS r ON (c.registry = r.id)
+ORDER BY
+  c.id;
@@ -0,0 +1,6 @@
+SELECT
+  id
+FROM
+  crawl_run
+ORDER BY
+  id DESC;
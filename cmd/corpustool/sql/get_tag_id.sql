@@ -1,6 +0,0 @@
-SELECT
-  id
-FROM
-  tag_name
-WHERE
-  value = ?;
@@ -0,0 +1,19 @@
+SELECT
+  m.digest,
+  r.packages,
+  r.unknown,
+  r.negligible,
+  r.low,
+  r.medium,
+  r.high,
+  r.critical,
+  r.package_hash,
+  r.vulnerability_hash
+FROM
+  vulnerability_report AS r
+  JOIN manifest AS m ON (r.manifest = m.id)
+WHERE
+  r.run = ?
+  AND r.error IS NULL
+ORDER BY
+  m.digest;
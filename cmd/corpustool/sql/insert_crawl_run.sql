@@ -0,0 +1,4 @@
+INSERT INTO
+  crawl_run (started, registry, api_root, version, options)
+VALUES
+  (unixepoch(), ?, ?, ?, ?) RETURNING id;
@@ -0,0 +1,12 @@
+INSERT INTO
+  fetch_error (
+    run,
+    registry,
+    namespace,
+    repository,
+    status,
+    message,
+    failed
+  )
+VALUES
+  (?, ?, ?, ?, ?, ?, unixepoch());
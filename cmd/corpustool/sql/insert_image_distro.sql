@@ -0,0 +1,40 @@
+INSERT INTO
+  image_distro (
+    manifest,
+    os,
+    architecture,
+    variant,
+    distro,
+    version,
+    layer,
+    checked
+  )
+SELECT
+  m.id,
+  ?2,
+  ?3,
+  ?4,
+  ?5,
+  ?6,
+  (
+    SELECT
+      id
+    FROM
+      layer
+    WHERE
+      digest = ?7
+  ),
+  unixepoch()
+FROM
+  manifest AS m
+WHERE
+  m.digest = ?1 ON CONFLICT (manifest) DO
+UPDATE
+SET
+  os = excluded.os,
+  architecture = excluded.architecture,
+  variant = excluded.variant,
+  distro = excluded.distro,
+  version = excluded.version,
+  layer = excluded.layer,
+  checked = excluded.checked;
@@ -0,0 +1,29 @@
+INSERT INTO
+  index_report (
+    indexer,
+    manifest,
+    state,
+    error,
+    submitted,
+    elapsed_ms,
+    polls
+  )
+SELECT
+  ?1,
+  m.id,
+  ?3,
+  ?4,
+  ?5,
+  ?6,
+  ?7
+FROM
+  manifest AS m
+WHERE
+  m.digest = ?2 ON CONFLICT (indexer, manifest) DO
+UPDATE
+SET
+  state = excluded.state,
+  error = excluded.error,
+  submitted = excluded.submitted,
+  elapsed_ms = excluded.elapsed_ms,
+  polls = excluded.polls;
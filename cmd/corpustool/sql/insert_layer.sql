@@ -0,0 +1,4 @@
+INSERT OR IGNORE INTO
+  layer (digest, size)
+VALUES
+  (?, ?);
@@ -0,0 +1,4 @@
+INSERT OR IGNORE INTO
+  manifest (digest, is_list)
+VALUES
+  (?, ?);
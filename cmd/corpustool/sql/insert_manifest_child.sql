@@ -0,0 +1,24 @@
+INSERT OR IGNORE INTO
+  manifest_child (parent, child, os, architecture, variant)
+VALUES
+  (
+    (
+      SELECT
+        id
+      FROM
+        manifest
+      WHERE
+        digest = ?
+    ),
+    (
+      SELECT
+        id
+      FROM
+        manifest
+      WHERE
+        digest = ?
+    ),
+    ?,
+    ?,
+    ?
+  );
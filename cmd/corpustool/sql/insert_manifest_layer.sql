@@ -0,0 +1,23 @@
+INSERT OR IGNORE INTO
+  manifest_layer (manifest, idx, layer, media_type)
+VALUES
+  (
+    (
+      SELECT
+        id
+      FROM
+        manifest
+      WHERE
+        digest = ?
+    ),
+    ?,
+    (
+      SELECT
+        id
+      FROM
+        layer
+      WHERE
+        digest = ?
+    ),
+    ?
+  );
@@ -0,0 +1,9 @@
+INSERT INTO
+  manifest (digest, is_list)
+SELECT
+  j.value ->> 'digest',
+  j.value ->> 'list'
+FROM
+  json_each(?) AS j
+WHERE
+  true ON CONFLICT (digest) DO NOTHING;
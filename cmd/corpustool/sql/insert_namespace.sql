@@ -1,4 +1,7 @@
-INSERT OR IGNORE INTO
+INSERT INTO
   namespace_name (value)
 VALUES
-  (?);
+  (?) ON CONFLICT (value) DO
+UPDATE
+SET
+  value = excluded.value RETURNING id;
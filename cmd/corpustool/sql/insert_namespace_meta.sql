@@ -0,0 +1,8 @@
+INSERT INTO
+  namespace_meta (registry, namespace, kind, updated)
+VALUES
+  (?, ?, ?, unixepoch()) ON CONFLICT (registry, namespace) DO
+UPDATE
+SET
+  kind = excluded.kind,
+  updated = excluded.updated;
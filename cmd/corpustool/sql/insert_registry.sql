@@ -1,4 +1,4 @@
 INSERT OR IGNORE INTO
-  tag_name (value)
+  registry (host)
 VALUES
   (?);
@@ -1,4 +0,0 @@
-INSERT OR IGNORE INTO
-  repo_tag (namespace, repository, tag)
-VALUES
-  (?, ?, ?);
@@ -0,0 +1,46 @@
+INSERT INTO
+  repo_tag (
+    registry,
+    namespace,
+    repository,
+    tag,
+    manifest,
+    first_run,
+    last_run,
+    first_seen,
+    last_seen,
+    start_ts,
+    last_modified,
+    size,
+    expiration
+  )
+SELECT
+  ?1,
+  ?2,
+  ?3,
+  t.id,
+  m.id,
+  ?5,
+  ?5,
+  unixepoch(),
+  unixepoch(),
+  j.value ->> 'start_ts',
+  j.value ->> 'last_modified',
+  j.value ->> 'size',
+  j.value ->> 'expiration'
+FROM
+  json_each(?4) AS j
+  JOIN tag_name AS t ON (t.value = j.value ->> 'name')
+  JOIN manifest AS m ON (m.digest = j.value ->> 'digest')
+WHERE
+  true ON CONFLICT (registry, namespace, repository, tag) DO
+UPDATE
+SET
+  manifest = excluded.manifest,
+  last_run = excluded.last_run,
+  last_seen = excluded.last_seen,
+  gone = NULL,
+  start_ts = excluded.start_ts,
+  last_modified = excluded.last_modified,
+  size = excluded.size,
+  expiration = excluded.expiration;
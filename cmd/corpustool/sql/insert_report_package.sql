@@ -0,0 +1,10 @@
+INSERT OR IGNORE INTO
+  report_package (run, manifest, package)
+SELECT
+  ?1,
+  m.id,
+  ?3
+FROM
+  manifest AS m
+WHERE
+  m.digest = ?2;
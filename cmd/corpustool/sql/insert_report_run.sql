@@ -0,0 +1,4 @@
+INSERT INTO
+  report_run (matcher, label, started)
+VALUES
+  (?, ?, unixepoch()) RETURNING id;
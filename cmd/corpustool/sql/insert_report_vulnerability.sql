@@ -0,0 +1,20 @@
+INSERT OR IGNORE INTO
+  report_vulnerability (
+    run,
+    manifest,
+    vulnerability,
+    package,
+    fixed_in_version,
+    severity
+  )
+SELECT
+  ?1,
+  m.id,
+  ?3,
+  ?4,
+  ?5,
+  ?6
+FROM
+  manifest AS m
+WHERE
+  m.digest = ?2;
@@ -0,0 +1,7 @@
+INSERT INTO
+  repository_fetch (registry, namespace, repository, fetched)
+VALUES
+  (?, ?, ?, unixepoch()) ON CONFLICT (registry, namespace, repository) DO
+UPDATE
+SET
+  fetched = excluded.fetched;
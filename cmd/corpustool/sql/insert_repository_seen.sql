@@ -0,0 +1,16 @@
+INSERT INTO
+  repository_seen (
+    registry,
+    namespace,
+    repository,
+    first_seen,
+    last_seen,
+    last_run
+  )
+VALUES
+  (?, ?, ?, unixepoch(), unixepoch(), ?) ON CONFLICT (registry, namespace, repository) DO
+UPDATE
+SET
+  last_seen = excluded.last_seen,
+  last_run = excluded.last_run,
+  gone = NULL;
@@ -0,0 +1,19 @@
+INSERT OR REPLACE INTO
+  run_tag (run, repo_tag, manifest)
+SELECT
+  ?1,
+  rt.id,
+  rt.manifest
+FROM
+  repo_tag AS rt
+  JOIN tag_name AS t ON (rt.tag = t.id)
+WHERE
+  rt.registry = ?2
+  AND rt.namespace = ?3
+  AND rt.repository = ?4
+  AND t.value IN (
+    SELECT
+      j.value ->> 'name'
+    FROM
+      json_each(?5) AS j
+  );
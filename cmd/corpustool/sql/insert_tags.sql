@@ -0,0 +1,8 @@
+INSERT INTO
+  tag_name (value)
+SELECT
+  j.value ->> 'name'
+FROM
+  json_each(?) AS j
+WHERE
+  true ON CONFLICT (value) DO NOTHING;
@@ -0,0 +1,32 @@
+INSERT INTO
+  vulnerability_report (
+    run,
+    manifest,
+    packages,
+    unknown,
+    negligible,
+    low,
+    medium,
+    high,
+    critical,
+    package_hash,
+    vulnerability_hash,
+    error
+  )
+SELECT
+  ?1,
+  m.id,
+  ?3,
+  ?4,
+  ?5,
+  ?6,
+  ?7,
+  ?8,
+  ?9,
+  ?10,
+  ?11,
+  ?12
+FROM
+  manifest AS m
+WHERE
+  m.digest = ?2;
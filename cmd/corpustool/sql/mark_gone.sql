@@ -0,0 +1,15 @@
+UPDATE repo_tag
+SET
+  gone = unixepoch()
+WHERE
+  registry = :registry
+  AND gone IS NULL
+  AND coalesce(last_run, 0) < :pass;
+
+UPDATE repository_seen
+SET
+  gone = unixepoch()
+WHERE
+  registry = :registry
+  AND gone IS NULL
+  AND coalesce(last_run, 0) < :pass;
@@ -0,0 +1,151 @@
+CREATE TABLE manifest (
+  id INTEGER PRIMARY KEY,
+  digest TEXT UNIQUE NOT NULL,
+  is_list INTEGER NOT NULL,
+  config TEXT
+);
+
+CREATE TABLE manifest_child (
+  parent INTEGER REFERENCES manifest (id),
+  child INTEGER REFERENCES manifest (id),
+  os TEXT NOT NULL,
+  architecture TEXT NOT NULL,
+  variant TEXT NOT NULL,
+  PRIMARY KEY (parent, child)
+);
+
+CREATE TABLE layer (
+  id INTEGER PRIMARY KEY,
+  digest TEXT UNIQUE NOT NULL,
+  size INTEGER NOT NULL
+);
+
+CREATE TABLE manifest_layer (
+  manifest INTEGER REFERENCES manifest (id),
+  idx INTEGER NOT NULL,
+  layer INTEGER REFERENCES layer (id),
+  media_type TEXT NOT NULL,
+  PRIMARY KEY (manifest, idx)
+);
+
+CREATE TABLE registry (
+  id INTEGER PRIMARY KEY,
+  host TEXT UNIQUE NOT NULL
+);
+
+-- Everything recorded by the original schema came from quay.io.
+INSERT INTO
+  registry (host)
+SELECT
+  'quay.io'
+WHERE
+  EXISTS (
+    SELECT
+      1
+    FROM
+      repo_tag
+  );
+
+CREATE TABLE repo_tag_new (
+  id INTEGER PRIMARY KEY,
+  registry INTEGER REFERENCES registry (id),
+  namespace INTEGER REFERENCES namespace_name (id),
+  repository INTEGER REFERENCES repository_name (id),
+  tag INTEGER REFERENCES tag_name (id),
+  manifest INTEGER REFERENCES manifest (id),
+  UNIQUE (registry, namespace, repository, tag)
+);
+
+INSERT INTO
+  repo_tag_new (id, registry, namespace, repository, tag)
+SELECT
+  id,
+  (
+    SELECT
+      id
+    FROM
+      registry
+    WHERE
+      host = 'quay.io'
+  ),
+  namespace,
+  repository,
+  tag
+FROM
+  repo_tag;
+
+DROP VIEW refs;
+
+DROP TABLE repo_tag;
+
+ALTER TABLE repo_tag_new
+RENAME TO repo_tag;
+
+CREATE VIEW repo_tag_repository (id, repository) AS
+SELECT
+  repo_tag.id,
+  h.host || '/' || iif(n.value = '', '', n.value || '/') || r.value
+FROM
+  repo_tag
+  JOIN registry AS h ON (repo_tag.registry = h.id)
+  JOIN namespace_name AS n ON (repo_tag.namespace = n.id)
+  JOIN repository_name AS r ON (repo_tag.repository = r.id);
+
+CREATE VIEW refs (ref) AS
+SELECT
+  rr.repository || ':' || t.value
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN tag_name AS t ON (repo_tag.tag = t.id);
+
+CREATE VIEW refs_by_digest (ref) AS
+SELECT DISTINCT
+  rr.repository || '@' || m.digest
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN manifest AS m ON (repo_tag.manifest = m.id);
+
+CREATE VIEW refs_by_platform (ref, os, architecture, variant) AS
+SELECT DISTINCT
+  rr.repository || '@' || m.digest,
+  c.os,
+  c.architecture,
+  c.variant
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN manifest_child AS c ON (repo_tag.manifest = c.parent)
+  JOIN manifest AS m ON (c.child = m.id);
+
+CREATE TABLE crawl_state (
+  registry INTEGER REFERENCES registry (id),
+  query TEXT NOT NULL,
+  page INTEGER NOT NULL,
+  updated INTEGER NOT NULL,
+  PRIMARY KEY (registry, query)
+);
+
+CREATE TABLE repository_fetch (
+  registry INTEGER REFERENCES registry (id),
+  namespace INTEGER REFERENCES namespace_name (id),
+  repository INTEGER REFERENCES repository_name (id),
+  fetched INTEGER NOT NULL,
+  PRIMARY KEY (registry, namespace, repository)
+);
+
+CREATE TABLE crawl_run (
+  id INTEGER PRIMARY KEY,
+  started INTEGER NOT NULL,
+  -- Whether the run listed every repository, starting from the first page,
+  -- so that a repository it didn't record wasn't there.
+  complete INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE run_tag (
+  run INTEGER REFERENCES crawl_run (id),
+  repo_tag INTEGER REFERENCES repo_tag (id),
+  manifest INTEGER REFERENCES manifest (id),
+  PRIMARY KEY (run, repo_tag)
+);
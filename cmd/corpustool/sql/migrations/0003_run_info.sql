@@ -0,0 +1,54 @@
+ALTER TABLE crawl_run
+ADD COLUMN finished INTEGER;
+
+ALTER TABLE crawl_run
+ADD COLUMN registry INTEGER REFERENCES registry (id);
+
+ALTER TABLE crawl_run
+ADD COLUMN api_root TEXT;
+
+ALTER TABLE crawl_run
+ADD COLUMN version TEXT;
+
+-- The crawl options, as a JSON object.
+ALTER TABLE crawl_run
+ADD COLUMN options TEXT;
+
+ALTER TABLE crawl_run
+ADD COLUMN repositories INTEGER;
+
+ALTER TABLE crawl_run
+ADD COLUMN tags INTEGER;
+
+-- One of 'success', 'interrupted' or 'error'. NULL while the run is going, or
+-- if it was recorded before this migration.
+ALTER TABLE crawl_run
+ADD COLUMN outcome TEXT;
+
+ALTER TABLE crawl_run
+ADD COLUMN message TEXT;
+
+ALTER TABLE repo_tag
+ADD COLUMN first_run INTEGER REFERENCES crawl_run (id);
+
+ALTER TABLE repo_tag
+ADD COLUMN last_run INTEGER REFERENCES crawl_run (id);
+
+UPDATE repo_tag
+SET
+  first_run = (
+    SELECT
+      min(run)
+    FROM
+      run_tag
+    WHERE
+      run_tag.repo_tag = repo_tag.id
+  ),
+  last_run = (
+    SELECT
+      max(run)
+    FROM
+      run_tag
+    WHERE
+      run_tag.repo_tag = repo_tag.id
+  );
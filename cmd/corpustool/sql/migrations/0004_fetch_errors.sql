@@ -0,0 +1,20 @@
+CREATE TABLE fetch_error (
+  id INTEGER PRIMARY KEY,
+  run INTEGER REFERENCES crawl_run (id),
+  registry INTEGER REFERENCES registry (id),
+  namespace INTEGER REFERENCES namespace_name (id),
+  repository INTEGER REFERENCES repository_name (id),
+  -- The HTTP status code, if the failure was an unexpected response.
+  status INTEGER,
+  message TEXT NOT NULL,
+  failed INTEGER NOT NULL,
+  -- The run that later fetched the repository successfully.
+  resolved INTEGER REFERENCES crawl_run (id)
+);
+
+CREATE INDEX fetch_error_outstanding ON fetch_error (registry, namespace, repository)
+WHERE
+  resolved IS NULL;
+
+ALTER TABLE crawl_run
+ADD COLUMN failed INTEGER;
@@ -0,0 +1,136 @@
+ALTER TABLE repo_tag
+ADD COLUMN first_seen INTEGER;
+
+ALTER TABLE repo_tag
+ADD COLUMN last_seen INTEGER;
+
+-- When the tag was found to be gone from the registry. NULL while it's
+-- present.
+ALTER TABLE repo_tag
+ADD COLUMN gone INTEGER;
+
+UPDATE repo_tag
+SET
+  first_seen = (
+    SELECT
+      started
+    FROM
+      crawl_run
+    WHERE
+      id = repo_tag.first_run
+  ),
+  last_seen = (
+    SELECT
+      started
+    FROM
+      crawl_run
+    WHERE
+      id = repo_tag.last_run
+  );
+
+CREATE TABLE repository_seen (
+  registry INTEGER REFERENCES registry (id),
+  namespace INTEGER REFERENCES namespace_name (id),
+  repository INTEGER REFERENCES repository_name (id),
+  first_seen INTEGER NOT NULL,
+  last_seen INTEGER NOT NULL,
+  last_run INTEGER REFERENCES crawl_run (id),
+  gone INTEGER,
+  PRIMARY KEY (registry, namespace, repository)
+);
+
+INSERT INTO
+  repository_seen (
+    registry,
+    namespace,
+    repository,
+    first_seen,
+    last_seen,
+    last_run
+  )
+SELECT
+  registry,
+  namespace,
+  repository,
+  coalesce(min(first_seen), unixepoch()),
+  coalesce(max(last_seen), unixepoch()),
+  max(last_run)
+FROM
+  repo_tag
+GROUP BY
+  registry,
+  namespace,
+  repository;
+
+INSERT OR IGNORE INTO
+  repository_seen (
+    registry,
+    namespace,
+    repository,
+    first_seen,
+    last_seen
+  )
+SELECT
+  registry,
+  namespace,
+  repository,
+  fetched,
+  fetched
+FROM
+  repository_fetch;
+
+-- The run that started the pass through the registry the checkpoint belongs to.
+ALTER TABLE crawl_state
+ADD COLUMN pass_run INTEGER REFERENCES crawl_run (id);
+
+CREATE TABLE repo_tag_archive (
+  registry TEXT NOT NULL,
+  namespace TEXT NOT NULL,
+  repository TEXT NOT NULL,
+  tag TEXT NOT NULL,
+  digest TEXT,
+  first_seen INTEGER,
+  last_seen INTEGER,
+  gone INTEGER NOT NULL,
+  archived INTEGER NOT NULL
+);
+
+DROP VIEW refs_by_platform;
+
+DROP VIEW refs_by_digest;
+
+DROP VIEW refs;
+
+CREATE VIEW refs (ref) AS
+SELECT
+  rr.repository || ':' || t.value
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN tag_name AS t ON (repo_tag.tag = t.id)
+WHERE
+  repo_tag.gone IS NULL;
+
+CREATE VIEW refs_by_digest (ref) AS
+SELECT DISTINCT
+  rr.repository || '@' || m.digest
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN manifest AS m ON (repo_tag.manifest = m.id)
+WHERE
+  repo_tag.gone IS NULL;
+
+CREATE VIEW refs_by_platform (ref, os, architecture, variant) AS
+SELECT DISTINCT
+  rr.repository || '@' || m.digest,
+  c.os,
+  c.architecture,
+  c.variant
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN manifest_child AS c ON (repo_tag.manifest = c.parent)
+  JOIN manifest AS m ON (c.child = m.id)
+WHERE
+  repo_tag.gone IS NULL;
@@ -0,0 +1,12 @@
+-- Tag metadata from the Quay API, as Unix times and bytes. NULL when unknown.
+ALTER TABLE repo_tag
+ADD COLUMN start_ts INTEGER;
+
+ALTER TABLE repo_tag
+ADD COLUMN last_modified INTEGER;
+
+ALTER TABLE repo_tag
+ADD COLUMN size INTEGER;
+
+ALTER TABLE repo_tag
+ADD COLUMN expiration INTEGER;
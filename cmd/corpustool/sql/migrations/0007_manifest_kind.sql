@@ -0,0 +1,12 @@
+-- Tags pointing at single-platform manifests are recorded alongside manifest
+-- lists, so expose which kind each tag points at.
+CREATE VIEW refs_by_kind (ref, kind) AS
+SELECT DISTINCT
+  rr.repository || '@' || m.digest,
+  iif(m.is_list, 'list', 'single')
+FROM
+  repo_tag
+  JOIN repo_tag_repository AS rr ON (repo_tag.id = rr.id)
+  JOIN manifest AS m ON (repo_tag.manifest = m.id)
+WHERE
+  repo_tag.gone IS NULL;
@@ -0,0 +1,24 @@
+-- Repository and namespace metadata from the Quay search results. A repository
+-- without metadata has a NULL is_public.
+ALTER TABLE repository_seen
+ADD COLUMN description TEXT;
+
+ALTER TABLE repository_seen
+ADD COLUMN is_public INTEGER;
+
+ALTER TABLE repository_seen
+ADD COLUMN kind TEXT;
+
+ALTER TABLE repository_seen
+ADD COLUMN popularity REAL;
+
+ALTER TABLE repository_seen
+ADD COLUMN last_modified INTEGER;
+
+CREATE TABLE namespace_meta (
+  registry INTEGER REFERENCES registry (id),
+  namespace INTEGER REFERENCES namespace_name (id),
+  kind TEXT NOT NULL,
+  updated INTEGER NOT NULL,
+  PRIMARY KEY (registry, namespace)
+);
@@ -0,0 +1,46 @@
+-- The distribution of each classified image manifest, from its config and
+-- release file. A manifest checked without finding a release file has a NULL
+-- distro.
+CREATE TABLE image_distro (
+  manifest INTEGER PRIMARY KEY REFERENCES manifest (id),
+  os TEXT NOT NULL,
+  architecture TEXT NOT NULL,
+  variant TEXT NOT NULL,
+  distro TEXT,
+  version TEXT,
+  layer INTEGER REFERENCES layer (id),
+  checked INTEGER NOT NULL
+);
+
+CREATE INDEX image_distro_release ON image_distro (distro, version);
+
+-- The release of each manifest with a known distribution. A manifest list
+-- takes the release of its children, which only differ in unusual images.
+CREATE VIEW manifest_release (manifest, distro, version) AS
+SELECT
+  manifest,
+  distro,
+  min(version)
+FROM
+  (
+    SELECT
+      manifest,
+      distro,
+      version
+    FROM
+      image_distro
+    WHERE
+      distro IS NOT NULL
+    UNION ALL
+    SELECT
+      c.parent,
+      d.distro,
+      d.version
+    FROM
+      manifest_child AS c
+      JOIN image_distro AS d ON (c.child = d.manifest)
+    WHERE
+      d.distro IS NOT NULL
+  )
+GROUP BY
+  manifest;
@@ -0,0 +1,15 @@
+-- The outcome of submitting each image manifest to a Clair indexer, keyed by
+-- the indexer's URL so that different deployments can be compared. Only the
+-- latest submission is kept. A manifest that couldn't be submitted or polled
+-- has a NULL state and the reason in error.
+CREATE TABLE index_report (
+  indexer TEXT NOT NULL,
+  manifest INTEGER REFERENCES manifest (id),
+  state TEXT,
+  error TEXT,
+  submitted INTEGER NOT NULL,
+  -- Milliseconds from submitting the manifest to seeing the final state.
+  elapsed_ms INTEGER NOT NULL,
+  polls INTEGER NOT NULL,
+  PRIMARY KEY (indexer, manifest)
+);
@@ -0,0 +1,58 @@
+-- Each pass fetching vulnerability reports from a Clair matcher.
+CREATE TABLE report_run (
+  id INTEGER PRIMARY KEY,
+  matcher TEXT NOT NULL,
+  -- A free-form label, such as the Clair version being tested.
+  label TEXT NOT NULL,
+  started INTEGER NOT NULL,
+  finished INTEGER
+);
+
+-- A summary of the vulnerability report for each manifest in a report run.
+-- The severity columns count vulnerabilities by Clair's normalized severity.
+-- The hashes are of the sets of packages and of affected package and
+-- vulnerability pairs, leaving out anything specific to a Clair deployment,
+-- such as IDs. A report that couldn't be fetched has only an error.
+CREATE TABLE vulnerability_report (
+  run INTEGER REFERENCES report_run (id),
+  manifest INTEGER REFERENCES manifest (id),
+  packages INTEGER,
+  unknown INTEGER,
+  negligible INTEGER,
+  low INTEGER,
+  medium INTEGER,
+  high INTEGER,
+  critical INTEGER,
+  package_hash TEXT,
+  vulnerability_hash TEXT,
+  error TEXT,
+  PRIMARY KEY (run, manifest)
+);
+
+-- The distinct packages in each report in a report run, described as
+-- compare lists them.
+CREATE TABLE report_package (
+  run INTEGER REFERENCES report_run (id),
+  manifest INTEGER REFERENCES manifest (id),
+  package TEXT NOT NULL,
+  PRIMARY KEY (run, manifest, package)
+);
+
+-- The vulnerabilities in each report in a report run, by the name Clair
+-- gives them, such as a CVE ID, along with the package each affects.
+CREATE TABLE report_vulnerability (
+  run INTEGER REFERENCES report_run (id),
+  manifest INTEGER REFERENCES manifest (id),
+  vulnerability TEXT NOT NULL,
+  package TEXT NOT NULL,
+  fixed_in_version TEXT NOT NULL,
+  severity TEXT NOT NULL,
+  PRIMARY KEY (
+    run,
+    manifest,
+    vulnerability,
+    package,
+    fixed_in_version,
+    severity
+  )
+);
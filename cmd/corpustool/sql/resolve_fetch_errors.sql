@@ -0,0 +1,8 @@
+UPDATE fetch_error
+SET
+  resolved = ?1
+WHERE
+  registry = ?2
+  AND namespace = ?3
+  AND repository = ?4
+  AND resolved IS NULL;
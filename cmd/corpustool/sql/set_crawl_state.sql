@@ -0,0 +1,8 @@
+INSERT INTO
+  crawl_state (registry, query, page, updated, pass_run)
+VALUES
+  (?, ?, ?, unixepoch(), ?) ON CONFLICT (registry, query) DO
+UPDATE
+SET
+  page = excluded.page,
+  updated = excluded.updated;
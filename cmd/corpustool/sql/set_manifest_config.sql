@@ -0,0 +1,5 @@
+UPDATE manifest
+SET
+  config = ?
+WHERE
+  digest = ?;
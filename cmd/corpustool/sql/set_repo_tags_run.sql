@@ -0,0 +1,8 @@
+UPDATE repo_tag
+SET
+  last_run = ?1
+WHERE
+  registry = ?2
+  AND namespace = ?3
+  AND repository = ?4
+  AND gone IS NULL;
@@ -0,0 +1,11 @@
+UPDATE repository_seen
+SET
+  description = ?4,
+  is_public = ?5,
+  kind = ?6,
+  popularity = ?7,
+  last_modified = ?8
+WHERE
+  registry = ?1
+  AND namespace = ?2
+  AND repository = ?3;
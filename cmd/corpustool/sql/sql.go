@@ -6,5 +6,10 @@ import (
 
 //go:generate find . -name *.sql -exec go run github.com/wasilibs/go-sql-formatter/v15/cmd/sql-formatter@latest --language sqlite --fix {} ;
 
-//go:embed *.sql
+// FS contains the queries used by corpustool.
+//
+// The "migrations" directory contains the schema, as a series of scripts
+// applied in lexical order. See the corpustool "migrate" function.
+//
+//go:embed *.sql migrations/*.sql
 var FS embed.FS
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"golang.org/x/sync/errgroup"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Index report states Clair doesn't move on from.
+const (
+	indexFinished = "IndexFinished"
+	indexError    = "IndexError"
+)
+
+// SubmitOptions is the configuration for the "submit" subcommand.
+type SubmitOptions struct {
+	// Indexer is the root URL of the Clair indexer.
+	Indexer string
+	// Refs, Registry, Filter, and Platform select the image manifests to
+	// submit, as for [MirrorOptions].
+	Refs     string
+	Registry string
+	Filter   Filter
+	Platform *Platform
+	// Limit, if positive, is the maximum number of manifests to submit.
+	Limit int
+	// Workers is the number of manifests being indexed at once.
+	Workers int
+	// Poll is how often an unfinished index report is checked.
+	Poll time.Duration
+	// Wait bounds how long each manifest may take to be indexed, including
+	// submitting it.
+	Wait time.Duration
+	// Resubmit submits manifests the indexer has already finished.
+	Resubmit bool
+}
+
+// submitMain parses the "submit" subcommand's flags from "args" and runs it.
+// The database and registry connection settings are taken from "global".
+func submitMain(ctx context.Context, global *Options, args []string) error {
+	opts := SubmitOptions{Workers: 4}
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s submit [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Indexer, "indexer", "http://localhost:6060", "root `URL` of the Clair indexer")
+	fs.StringVar(&opts.Refs, "refs", "", "submit the references in `file` (\"-\" for stdin) instead of every ref in the database")
+	fs.StringVar(&opts.Registry, "registry", "", "only submit refs from registry `host`")
+	fs.Var((*listFlag)(&opts.Filter.Namespaces), "namespace", "only submit these namespaces (comma-separated, repeatable)")
+	fs.Var((*listFlag)(&opts.Filter.ExcludeNamespaces), "exclude-namespace", "skip these namespaces (comma-separated, repeatable)")
+	fs.Func("repository", "only submit repositories whose \"namespace/name\" matches `regexp`", regexpFlag(&opts.Filter.Repository))
+	fs.Func("tag", "only submit tags matching `regexp`", regexpFlag(&opts.Filter.Tag))
+	fs.Var((*listFlag)(&opts.Filter.Distros), "distro", "only submit images of these distributions, as `id[:version]` (comma-separated, repeatable)")
+	fs.Func("platform", "only submit the `os/arch[/variant]` manifest out of manifest lists", func(v string) error {
+		p, err := parsePlatform(v)
+		opts.Platform = p
+		return err
+	})
+	fs.IntVar(&opts.Limit, "limit", 0, "submit at most `N` manifests")
+	fs.IntVar(&opts.Workers, "workers", opts.Workers, "number of manifests to index concurrently")
+	fs.DurationVar(&opts.Poll, "poll", time.Second, "check unfinished index reports every `duration`")
+	fs.DurationVar(&opts.Wait, "wait", 10*time.Minute, "give up on a manifest that isn't indexed within `duration`")
+	fs.BoolVar(&opts.Resubmit, "resubmit", false, "submit manifests the indexer has already finished")
+	fs.Parse(args)
+	return Submit(ctx, global, opts)
+}
+
+// Submit submits the image manifests in the database selected by "opts" to a
+// Clair indexer and records the outcomes, using the database and registry
+// connection settings from "global".
+func Submit(ctx context.Context, global *Options, opts SubmitOptions) error {
+	conn, err := sqlite.OpenConn(global.DB)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+	if err := migrate(ctx, conn); err != nil {
+		return err
+	}
+	return submit(ctx, conn, global, opts)
+}
+
+func submit(ctx context.Context, conn *sqlite.Conn, global *Options, opts SubmitOptions) error {
+	root, err := url.Parse(opts.Indexer)
+	if err != nil {
+		return err
+	}
+	subs, err := selectSubmissions(ctx, conn, &opts)
+	if err != nil {
+		return err
+	}
+	s := &submitter{
+		ix: &indexer{
+			// Each manifest is bounded by opts.Wait instead of a
+			// per-request timeout, as Clair may not respond to a
+			// submission until it's done indexing.
+			c:    &http.Client{Transport: &retryTransport{Attempts: global.Attempts}},
+			root: root,
+		},
+		regs: newRegistries(global),
+		opts: &opts,
+	}
+	slog.InfoContext(ctx, "submitting manifests", "count", len(subs), "indexer", opts.Indexer)
+
+	var mu sync.Mutex
+	var finished, errored, failed int
+	var elapsed []time.Duration
+	eg, gctx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(opts.Workers, 1))
+	for _, sub := range subs {
+		eg.Go(func() error {
+			res := s.index(gctx, &sub)
+			if gctx.Err() != nil {
+				// Interrupted, so the result says nothing about Clair.
+				return context.Cause(gctx)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := insertIndexReport(conn, opts.Indexer, res); err != nil {
+				return err
+			}
+			l := slog.With("ref", sub.Ref.DigestRef(), "state", res.State, "elapsed", res.Elapsed)
+			switch {
+			case res.State == indexFinished:
+				finished++
+				elapsed = append(elapsed, res.Elapsed)
+				l.DebugContext(gctx, "indexed manifest")
+			case res.State == indexError:
+				errored++
+				l.WarnContext(gctx, "indexing failed", "reason", res.Err)
+			default:
+				failed++
+				l.WarnContext(gctx, "submitting manifest failed", "reason", res.Err)
+			}
+			return nil
+		})
+	}
+	err = eg.Wait()
+	slices.Sort(elapsed)
+	slog.InfoContext(ctx, "submitted manifests",
+		"finished", finished,
+		"errored", errored,
+		"failed", failed,
+		"p50", percentile(elapsed, 50),
+		"p95", percentile(elapsed, 95),
+		"max", percentile(elapsed, 100))
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d manifests failed", failed, len(subs))
+	}
+	return err
+}
+
+// percentile returns the "p"th percentile of the sorted durations "ds", or
+// zero if there are none.
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	return ds[(len(ds)-1)*p/100]
+}
+
+// submission is an image manifest to submit, by way of a ref to pull its
+// layers from.
+type submission struct {
+	// Ref is a ref in a repository containing the manifest, with the
+	// manifest's digest.
+	Ref    Ref
+	Layers []Descriptor
+}
+
+// selectSubmissions reads the image manifests selected by "opts" from the
+// database on "conn", with their layers. The children of manifest lists are
+// submitted in their place. Manifests without recorded layers can't be
+// submitted and are left out, as are manifests the indexer has already
+// finished unless "opts.Resubmit" is set.
+func selectSubmissions(ctx context.Context, conn *sqlite.Conn, opts *SubmitOptions) ([]submission, error) {
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Refs != "" {
+		byTag := make(map[string]string, len(refs))
+		for _, r := range refs {
+			byTag[r.TagRef()] = r.Digest
+		}
+		refs, err = readRefs(opts.Refs)
+		if err != nil {
+			return nil, err
+		}
+		for i := range refs {
+			if refs[i].Digest == "" {
+				refs[i].Digest = byTag[refs[i].TagRef()]
+			}
+		}
+	} else {
+		refs = filterRefs(refs, opts.Registry, &opts.Filter)
+	}
+
+	type child struct {
+		Digest   string
+		Platform Platform
+	}
+	children := make(map[string][]child)
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_manifest_children.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			p := stmt.ColumnText(0)
+			children[p] = append(children[p], child{
+				Digest: stmt.ColumnText(1),
+				Platform: Platform{
+					OS:           stmt.ColumnText(2),
+					Architecture: stmt.ColumnText(3),
+					Variant:      stmt.ColumnText(4),
+				},
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	layers := make(map[string][]Descriptor)
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_manifest_layers.sql", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			m := stmt.ColumnText(0)
+			layers[m] = append(layers[m], Descriptor{
+				Digest: stmt.ColumnText(1),
+				Size:   stmt.ColumnInt64(2),
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool)
+	if !opts.Resubmit {
+		err = sqlitex.ExecuteFS(conn, sql.FS, "get_index_reports.sql", &sqlitex.ExecOptions{
+			Args: []any{opts.Indexer},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				done[stmt.ColumnText(0)] = stmt.ColumnText(1) == indexFinished
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out []submission
+	var unlayered, finished int
+	seen := make(map[string]bool)
+	add := func(r Ref, d string) {
+		if seen[d] {
+			return
+		}
+		seen[d] = true
+		ls, ok := layers[d]
+		switch {
+		case !ok:
+			unlayered++
+		case done[d]:
+			finished++
+		default:
+			r.Digest = d
+			out = append(out, submission{Ref: r, Layers: ls})
+		}
+	}
+	for _, r := range refs {
+		if r.Digest == "" {
+			unlayered++
+			continue
+		}
+		cs, ok := children[r.Digest]
+		if !ok {
+			add(r, r.Digest)
+			continue
+		}
+		for _, c := range cs {
+			if opts.Platform == nil || matchPlatform(opts.Platform, &c.Platform) {
+				add(r, c.Digest)
+			}
+		}
+	}
+	if unlayered > 0 {
+		slog.InfoContext(ctx, "skipping manifests without recorded layers", "count", unlayered)
+	}
+	if finished > 0 {
+		slog.InfoContext(ctx, "skipping manifests already indexed", "count", finished)
+	}
+	if opts.Limit > 0 && len(out) > opts.Limit {
+		out = out[:opts.Limit]
+	}
+	return out, nil
+}
+
+// indexResult is the outcome of submitting one manifest.
+type indexResult struct {
+	Digest string
+	// State is the last state the indexer reported, or empty if it never
+	// reported one.
+	State string
+	// Err is why the manifest couldn't be submitted or wasn't indexed.
+	Err       error
+	Submitted time.Time
+	Elapsed   time.Duration
+	Polls     int
+}
+
+// insertIndexReport records the result "res" from the indexer at the URL
+// "indexer".
+func insertIndexReport(conn *sqlite.Conn, indexer string, res *indexResult) error {
+	var state, msg any
+	if res.State != "" {
+		state = res.State
+	}
+	if res.Err != nil {
+		msg = res.Err.Error()
+	}
+	return sqlitex.ExecuteFS(conn, sql.FS, "insert_index_report.sql", &sqlitex.ExecOptions{
+		Args: []any{
+			indexer,
+			res.Digest,
+			state,
+			msg,
+			res.Submitted.Unix(),
+			res.Elapsed.Milliseconds(),
+			res.Polls,
+		},
+	})
+}
+
+// submitter submits manifests to an indexer, pointing it at the registries
+// the manifests' layers are in.
+type submitter struct {
+	ix   *indexer
+	regs *registries
+	opts *SubmitOptions
+}
+
+// index submits "sub" and polls its index report until it's finished or
+// "s.opts.Wait" runs out.
+func (s *submitter) index(ctx context.Context, sub *submission) *indexResult {
+	res := &indexResult{Digest: sub.Ref.Digest, Submitted: time.Now()}
+	defer func() {
+		res.Elapsed = time.Since(res.Submitted)
+	}()
+	wctx, cancel := context.WithTimeoutCause(ctx, s.opts.Wait,
+		fmt.Errorf("not indexed within %v", s.opts.Wait))
+	defer cancel()
+
+	m, err := s.manifest(wctx, sub)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	rep, err := s.ix.Index(wctx, m)
+	for err == nil {
+		res.State = rep.State
+		if rep.State == indexFinished || rep.State == indexError {
+			break
+		}
+		t := time.NewTimer(s.opts.Poll)
+		select {
+		case <-wctx.Done():
+			t.Stop()
+			err = context.Cause(wctx)
+			continue
+		case <-t.C:
+		}
+		res.Polls++
+		rep, err = s.ix.Report(wctx, sub.Ref.Digest)
+	}
+	switch {
+	case wctx.Err() != nil && ctx.Err() == nil:
+		res.Err = context.Cause(wctx)
+	case err != nil:
+		res.Err = err
+	case rep.State == indexError:
+		res.Err = errors.New(cmp.Or(rep.Err, "no error reported"))
+	}
+	return res
+}
+
+// manifest builds the request to index "sub", with layer URIs pointing at
+// its repository and the credentials needed to pull them.
+func (s *submitter) manifest(ctx context.Context, sub *submission) (*clairManifest, error) {
+	reg, err := s.regs.Get(sub.Ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(sub.Ref.Namespace, sub.Ref.Repository)
+	// The indexer may fetch layers at any point until the wait runs out.
+	auth, err := reg.PullAuth(ctx, name, s.opts.Wait)
+	if err != nil {
+		return nil, err
+	}
+	var h map[string][]string
+	if auth != "" {
+		h = map[string][]string{`Authorization`: {auth}}
+	}
+	m := &clairManifest{Hash: sub.Ref.Digest}
+	for _, l := range sub.Layers {
+		m.Layers = append(m.Layers, clairLayer{
+			Hash:    l.Digest,
+			URI:     reg.root.JoinPath("v2", name, "blobs", l.Digest).String(),
+			Headers: h,
+		})
+	}
+	return m, nil
+}
+
+// clairManifest is the body of a request to index a manifest.
+type clairManifest struct {
+	Hash   string       `json:"hash"`
+	Layers []clairLayer `json:"layers"`
+}
+
+type clairLayer struct {
+	Hash    string              `json:"hash"`
+	URI     string              `json:"uri"`
+	Headers map[string][]string `json:"headers,omitempty"`
+}
+
+// indexReport is the part of a Clair index report corpustool looks at.
+type indexReport struct {
+	State string `json:"state"`
+	Err   string `json:"err"`
+}
+
+// indexer is a client for the Clair indexer API.
+type indexer struct {
+	c    *http.Client
+	root *url.URL
+}
+
+// Index submits "m" for indexing and returns the index report in whatever
+// state it's in.
+func (ix *indexer) Index(ctx context.Context, m *clairManifest) (*indexReport, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	u := ix.root.JoinPath("indexer", "api", "v1", "index_report")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	return ix.report(req)
+}
+
+// Report fetches the index report for the manifest "digest".
+func (ix *indexer) Report(ctx context.Context, digest string) (*indexReport, error) {
+	u := ix.root.JoinPath("indexer", "api", "v1", "index_report", digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return ix.report(req)
+}
+
+// report issues "req" and decodes the index report in the response.
+func (ix *indexer) report(req *http.Request) (*indexReport, error) {
+	req.Header.Set(`Accept`, `application/json`)
+	res, err := ix.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	default:
+		return nil, clairError(res)
+	}
+	var rep indexReport
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+// clairError returns the error for the unexpected response "res", including
+// the message from Clair's error body if there is one.
+func clairError(res *http.Response) error {
+	err := responseError(res)
+	var e struct {
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&e) == nil && e.Message != "" {
+		return fmt.Errorf("%w: %s", err, e.Message)
+	}
+	return err
+}
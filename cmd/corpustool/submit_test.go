@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// fakeClair is an indexer that takes a couple of polls to finish indexing
+// "sha256:amd64", and fails some manifests. It also serves the token flow of
+// a registry, so layer URIs can point back at it.
+type fakeClair struct {
+	mu     sync.Mutex
+	posted map[string]clairManifest
+	polls  map[string]int
+	// stuck keeps every manifest from finishing.
+	stuck bool
+}
+
+func (f *fakeClair) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	report := func(d string) {
+		rep := indexReport{State: indexFinished}
+		switch {
+		case f.stuck:
+			rep.State = "ScanLayers"
+		case d == "sha256:amd64" && f.polls[d] < 2:
+			rep.State = [...]string{"CheckManifest", "ScanLayers"}[f.polls[d]]
+		case d == "sha256:single":
+			rep.State, rep.Err = indexError, "fetch failed"
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(&rep)
+	}
+	switch p := r.URL.Path; {
+	case p == "/v2/":
+		w.Header().Set(`WWW-Authenticate`, `Bearer realm="http://`+r.Host+`/token",service="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	case p == "/token":
+		w.Write([]byte(`{"token": "tok"}`))
+	case p == "/indexer/api/v1/index_report" && r.Method == http.MethodPost:
+		var m clairManifest
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if m.Hash == "sha256:bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": "bad-request", "message": "bad layers"}`))
+			return
+		}
+		f.posted[m.Hash] = m
+		f.polls[m.Hash] = 0
+		report(m.Hash)
+	case strings.HasPrefix(p, "/indexer/api/v1/index_report/"):
+		d := strings.TrimPrefix(p, "/indexer/api/v1/index_report/")
+		f.polls[d]++
+		report(d)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	image := func(l string) *Manifest {
+		return &Manifest{Layers: []Descriptor{{Digest: "sha256:base", Size: 10}, {Digest: l, Size: 1}}}
+	}
+	rs := []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:list", IsList: true}},
+			Indexes: []fetchedIndex{{
+				Digest: "sha256:list",
+				Index: &Index{Manifests: []Descriptor{
+					{MediaType: mediaTypeOCIManifest, Digest: "sha256:amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+					{MediaType: mediaTypeOCIManifest, Digest: "sha256:arm64", Platform: &Platform{OS: "linux", Architecture: "arm64"}},
+				}},
+			}},
+			Manifests: []fetchedManifest{
+				{Digest: "sha256:amd64", Manifest: image("sha256:l1")},
+				{Digest: "sha256:arm64", Manifest: image("sha256:l2")},
+			},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "single"}, Page: 1},
+			Tags:      []Tag{{Name: "v1", Digest: "sha256:single"}},
+			Manifests: []fetchedManifest{{Digest: "sha256:single", Manifest: image("sha256:l3")}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "bad"}, Page: 1},
+			Tags:      []Tag{{Name: "v1", Digest: "sha256:bad"}},
+			Manifests: []fetchedManifest{{Digest: "sha256:bad", Manifest: image("sha256:l4")}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "unlayered"}, Page: 1},
+			Tags:      []Tag{{Name: "v1", Digest: "sha256:unlayered"}},
+		},
+	}
+	writeResults(t, w, rs)
+
+	f := &fakeClair{posted: make(map[string]clairManifest), polls: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	// Point the refs at the fake registry.
+	err := sqlitex.ExecuteTransient(conn, `UPDATE registry SET host = ?;`, &sqlitex.ExecOptions{
+		Args: []any{u.Host},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	global := &Options{PlainHTTP: true, Attempts: 1}
+	opts := SubmitOptions{Indexer: srv.URL, Workers: 2, Poll: time.Millisecond, Wait: time.Minute}
+	reports := func() string {
+		return queryString(t, conn, `SELECT m.digest || ' ' || coalesce(r.state, 'null') || ' ' || r.polls || ' ' || coalesce(r.error, '')
+FROM index_report AS r JOIN manifest AS m ON (r.manifest = m.id) ORDER BY m.digest;`)
+	}
+
+	err = submit(ctx, conn, global, opts)
+	if err == nil || err.Error() != "1 of 4 manifests failed" {
+		t.Errorf("error: got: %v", err)
+	}
+	want := strings.Join([]string{
+		"sha256:amd64 IndexFinished 2 ",
+		"sha256:arm64 IndexFinished 0 ",
+		"sha256:bad null 0 unexpected response: 400 Bad Request: bad layers",
+		"sha256:single IndexError 0 fetch failed",
+	}, ",")
+	if got := reports(); got != want {
+		t.Errorf("reports:\ngot:  %q\nwant: %q", got, want)
+	}
+	m := f.posted["sha256:amd64"]
+	if len(m.Layers) != 2 {
+		t.Fatalf("layers: got: %+v", m.Layers)
+	}
+	l := m.Layers[1]
+	if want := srv.URL + "/v2/ns/a/blobs/sha256:l1"; l.Hash != "sha256:l1" || l.URI != want {
+		t.Errorf("layer: got: %+v, want URI: %s", l, want)
+	}
+	if got := l.Headers["Authorization"]; len(got) != 1 || got[0] != "Bearer tok" {
+		t.Errorf("layer headers: got: %q", got)
+	}
+
+	t.Run("Resume", func(t *testing.T) {
+		clear(f.posted)
+		submit(ctx, conn, global, opts)
+		if _, ok := f.posted["sha256:single"]; len(f.posted) != 1 || !ok {
+			t.Errorf("resubmitted: got: %v", f.posted)
+		}
+
+		clear(f.posted)
+		amd64, _ := parsePlatform("linux/amd64")
+		opts := opts
+		opts.Resubmit, opts.Platform = true, amd64
+		submit(ctx, conn, global, opts)
+		if _, ok := f.posted["sha256:arm64"]; len(f.posted) != 2 || ok {
+			t.Errorf("resubmitted: got: %v", f.posted)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		f.mu.Lock()
+		f.stuck = true
+		f.mu.Unlock()
+		opts := opts
+		opts.Resubmit, opts.Limit, opts.Wait = true, 1, 50*time.Millisecond
+		if err := submit(ctx, conn, global, opts); err == nil {
+			t.Error("stuck manifest didn't fail")
+		}
+		got := queryString(t, conn, `SELECT coalesce(r.state, 'null') || ' ' || r.error
+FROM index_report AS r JOIN manifest AS m ON (r.manifest = m.id) WHERE m.digest = 'sha256:amd64';`)
+		if want := "ScanLayers not indexed within 50ms"; got != want {
+			t.Errorf("report: got: %q, want: %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"golang.org/x/sync/errgroup"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// VulnsOptions is the configuration for the "vulns" subcommand.
+type VulnsOptions struct {
+	// Matcher is the root URL of the Clair matcher.
+	Matcher string
+	// Indexer selects the manifests this indexer has finished, as recorded
+	// by "submit". If empty, Matcher is used, as for a combined deployment.
+	Indexer string
+	// Label is recorded with the run, to tell runs apart when comparing.
+	Label string
+	// Limit, if positive, is the maximum number of reports to fetch.
+	Limit int
+	// Workers is the number of reports fetched concurrently.
+	Workers int
+}
+
+// vulnsMain parses the "vulns" subcommand's flags from "args" and runs it.
+// The database and HTTP settings are taken from "global".
+func vulnsMain(ctx context.Context, global *Options, args []string) error {
+	opts := VulnsOptions{Workers: 4}
+	fs := flag.NewFlagSet("vulns", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s vulns [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Matcher, "matcher", "http://localhost:6060", "root `URL` of the Clair matcher")
+	fs.StringVar(&opts.Indexer, "indexer", "", "fetch reports for the manifests indexed by the indexer at `URL` (default: the matcher)")
+	fs.StringVar(&opts.Label, "label", "", "label to record with the run, such as the Clair version")
+	fs.IntVar(&opts.Limit, "limit", 0, "fetch at most `N` reports")
+	fs.IntVar(&opts.Workers, "workers", opts.Workers, "number of reports to fetch concurrently")
+	fs.Parse(args)
+	if opts.Indexer == "" {
+		opts.Indexer = opts.Matcher
+	}
+	return Vulns(ctx, global, opts)
+}
+
+// Vulns fetches the vulnerability report of every manifest the indexer has
+// finished and records a summary of each as a new report run, using the
+// database and HTTP settings from "global".
+func Vulns(ctx context.Context, global *Options, opts VulnsOptions) error {
+	conn, err := sqlite.OpenConn(global.DB)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+	if err := migrate(ctx, conn); err != nil {
+		return err
+	}
+	_, err = vulns(ctx, conn, global.httpClient(), opts)
+	return err
+}
+
+// vulns does the work of [Vulns] on "conn", and returns the ID of the report
+// run.
+func vulns(ctx context.Context, conn *sqlite.Conn, c *http.Client, opts VulnsOptions) (int64, error) {
+	root, err := url.Parse(opts.Matcher)
+	if err != nil {
+		return 0, err
+	}
+	var digests []string
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_indexed_manifests.sql", &sqlitex.ExecOptions{
+		Args: []any{opts.Indexer},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			digests = append(digests, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if opts.Limit > 0 && len(digests) > opts.Limit {
+		digests = digests[:opts.Limit]
+	}
+	var runID int64
+	err = sqlitex.ExecuteFS(conn, sql.FS, "insert_report_run.sql", &sqlitex.ExecOptions{
+		Args: []any{opts.Matcher, opts.Label},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			runID = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.InfoContext(ctx, "fetching vulnerability reports", "run", runID, "count", len(digests), "matcher", opts.Matcher)
+
+	m := &matcher{c: c, root: root}
+	var mu sync.Mutex
+	var failed int
+	eg, gctx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(opts.Workers, 1))
+	for _, d := range digests {
+		eg.Go(func() error {
+			rep, err := m.Report(gctx, d)
+			if gctx.Err() != nil {
+				return context.Cause(gctx)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			var s *ReportSummary
+			if err == nil {
+				s = summarize(rep)
+			} else {
+				slog.WarnContext(gctx, "fetching vulnerability report failed", "digest", d, "reason", err)
+				failed++
+			}
+			return insertVulnerabilityReport(conn, runID, d, s, err)
+		})
+	}
+	err = eg.Wait()
+	if err == nil {
+		err = sqlitex.ExecuteFS(conn, sql.FS, "finish_report_run.sql", &sqlitex.ExecOptions{
+			Args: []any{runID},
+		})
+	}
+	slog.InfoContext(ctx, "fetched vulnerability reports", "run", runID, "reports", len(digests)-failed, "failed", failed)
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d reports failed", failed, len(digests))
+	}
+	return runID, err
+}
+
+// insertVulnerabilityReport records the summary "s" of the report for the
+// manifest "digest" in the report run "run", along with its packages and
+// vulnerabilities, or "fetchErr" if there isn't one.
+func insertVulnerabilityReport(conn *sqlite.Conn, run int64, digest string, s *ReportSummary, fetchErr error) (err error) {
+	defer sqlitex.Save(conn)(&err)
+	args := []any{run, digest}
+	if s != nil {
+		sv := &s.Severities
+		args = append(args,
+			s.Packages,
+			sv.Unknown, sv.Negligible, sv.Low, sv.Medium, sv.High, sv.Critical,
+			s.PackageHash, s.VulnerabilityHash,
+			nil)
+	} else {
+		args = append(args, make([]any, 9)...)
+		args = append(args, fetchErr.Error())
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "insert_vulnerability_report.sql", &sqlitex.ExecOptions{
+		Args: args,
+	})
+	if err != nil || s == nil {
+		return err
+	}
+	for _, p := range s.PackageList {
+		err := sqlitex.ExecuteFS(conn, sql.FS, "insert_report_package.sql", &sqlitex.ExecOptions{
+			Args: []any{run, digest, p},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range s.VulnerabilityList {
+		err := sqlitex.ExecuteFS(conn, sql.FS, "insert_report_vulnerability.sql", &sqlitex.ExecOptions{
+			Args: []any{run, digest, v.Name, v.Package, v.FixedInVersion, v.Severity},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReportSummary is what's kept of a vulnerability report.
+type ReportSummary struct {
+	// Packages is the number of distinct packages found.
+	Packages int `json:"packages"`
+	// Severities counts the vulnerabilities found by normalized severity.
+	Severities Severities `json:"severities"`
+	// PackageHash and VulnerabilityHash identify the set of packages and the
+	// set of affected package and vulnerability pairs, independent of the
+	// Clair deployment the report came from.
+	PackageHash       string `json:"package_hash"`
+	VulnerabilityHash string `json:"vulnerability_hash"`
+	// PackageList and VulnerabilityList are the distinct packages and
+	// vulnerabilities found, sorted. They're recorded in tables of their
+	// own, so are left out of the summary's JSON.
+	PackageList       []string              `json:"-"`
+	VulnerabilityList []ReportVulnerability `json:"-"`
+}
+
+// ReportVulnerability is a vulnerability found in a package, as recorded
+// independent of the Clair deployment.
+type ReportVulnerability struct {
+	// Name is the name Clair gives the vulnerability, such as a CVE ID.
+	Name string `json:"name"`
+	// Package describes the affected package; see [clairPackage.String].
+	Package        string `json:"package"`
+	FixedInVersion string `json:"fixed_in_version,omitempty"`
+	Severity       string `json:"severity"`
+}
+
+func (v ReportVulnerability) String() string {
+	s := v.Name + " " + v.Severity + " in " + v.Package
+	if v.FixedInVersion != "" {
+		s += ", fixed in " + v.FixedInVersion
+	}
+	return s
+}
+
+// compareVulnerabilities orders vulnerabilities by name, then by package.
+func compareVulnerabilities(a, b ReportVulnerability) int {
+	return cmp.Or(
+		cmp.Compare(a.Name, b.Name),
+		cmp.Compare(a.Package, b.Package),
+		cmp.Compare(a.FixedInVersion, b.FixedInVersion),
+		cmp.Compare(a.Severity, b.Severity),
+	)
+}
+
+// Severities are counts of vulnerabilities by Clair's normalized severity.
+type Severities struct {
+	Unknown    int `json:"unknown"`
+	Negligible int `json:"negligible"`
+	Low        int `json:"low"`
+	Medium     int `json:"medium"`
+	High       int `json:"high"`
+	Critical   int `json:"critical"`
+}
+
+// vulnerabilityReport is the part of a Clair vulnerability report corpustool
+// looks at.
+type vulnerabilityReport struct {
+	Packages               map[string]clairPackage       `json:"packages"`
+	Vulnerabilities        map[string]clairVulnerability `json:"vulnerabilities"`
+	PackageVulnerabilities map[string][]string           `json:"package_vulnerabilities"`
+}
+
+type clairPackage struct {
+	Name    string        `json:"name"`
+	Version string        `json:"version"`
+	Kind    string        `json:"kind"`
+	Arch    string        `json:"arch"`
+	Module  string        `json:"module"`
+	Source  *clairPackage `json:"source"`
+}
+
+// String describes the package so that it's identified across Clair
+// deployments: its name and version, then whichever of its kind,
+// architecture, module and source package are known.
+func (p *clairPackage) String() string {
+	var extra []string
+	for _, s := range []string{p.Kind, p.Arch} {
+		if s != "" {
+			extra = append(extra, s)
+		}
+	}
+	if p.Module != "" {
+		extra = append(extra, "module "+p.Module)
+	}
+	if s := p.Source; s != nil && s.Name != "" {
+		extra = append(extra, "source "+s.Name+" "+s.Version)
+	}
+	out := p.Name + " " + p.Version
+	if len(extra) > 0 {
+		out += " (" + strings.Join(extra, ", ") + ")"
+	}
+	return out
+}
+
+type clairVulnerability struct {
+	Name               string `json:"name"`
+	FixedInVersion     string `json:"fixed_in_version"`
+	NormalizedSeverity string `json:"normalized_severity"`
+}
+
+// summarize reduces "rep" to counts and hashes that can be compared between
+// Clair deployments.
+func summarize(rep *vulnerabilityReport) *ReportSummary {
+	var s ReportSummary
+	for _, p := range rep.Packages {
+		s.PackageList = append(s.PackageList, p.String())
+	}
+	for id, vs := range rep.PackageVulnerabilities {
+		p, ok := rep.Packages[id]
+		if !ok {
+			continue
+		}
+		for _, vid := range vs {
+			v, ok := rep.Vulnerabilities[vid]
+			if !ok {
+				continue
+			}
+			s.VulnerabilityList = append(s.VulnerabilityList, ReportVulnerability{
+				Name:           v.Name,
+				Package:        p.String(),
+				FixedInVersion: v.FixedInVersion,
+				Severity:       v.NormalizedSeverity,
+			})
+		}
+	}
+	for _, v := range rep.Vulnerabilities {
+		sv := &s.Severities
+		switch v.NormalizedSeverity {
+		case "Negligible":
+			sv.Negligible++
+		case "Low":
+			sv.Low++
+		case "Medium":
+			sv.Medium++
+		case "High":
+			sv.High++
+		case "Critical":
+			sv.Critical++
+		default:
+			sv.Unknown++
+		}
+	}
+	slices.Sort(s.PackageList)
+	s.PackageList = slices.Compact(s.PackageList)
+	slices.SortFunc(s.VulnerabilityList, compareVulnerabilities)
+	s.VulnerabilityList = slices.Compact(s.VulnerabilityList)
+
+	s.Packages = len(s.PackageList)
+	s.PackageHash = hashLines(s.PackageList)
+	vulns := make([]string, len(s.VulnerabilityList))
+	for i, v := range s.VulnerabilityList {
+		vulns[i] = strings.Join([]string{v.Name, v.Package, v.FixedInVersion, v.Severity}, "\t")
+	}
+	s.VulnerabilityHash = hashLines(vulns)
+	return &s
+}
+
+// hashLines returns the hash of "lines", each terminated by a newline.
+func hashLines(lines []string) string {
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+		h.Write([]byte{'\n'})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// matcher is a client for the Clair matcher API.
+type matcher struct {
+	c    *http.Client
+	root *url.URL
+}
+
+// Report fetches the vulnerability report for the manifest "digest".
+func (m *matcher) Report(ctx context.Context, digest string) (*vulnerabilityReport, error) {
+	u := m.root.JoinPath("matcher", "api", "v1", "vulnerability_report", digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Accept`, `application/json`)
+	res, err := m.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, clairError(res)
+	}
+	var rep vulnerabilityReport
+	if err := json.NewDecoder(res.Body).Decode(&rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReport builds a vulnerability report with IDs offset by "id", so
+// reports from different deployments can be faked.
+func testReport(id int, vulns ...string) *vulnerabilityReport {
+	key := func(n int) string { return string(rune('0' + id + n)) }
+	rep := &vulnerabilityReport{
+		Packages: map[string]clairPackage{
+			key(0): {Name: "openssl", Version: "3.0.7", Kind: "binary", Source: &clairPackage{Name: "openssl", Version: "3.0.7"}},
+			key(1): {Name: "zlib", Version: "1.2.13", Kind: "binary"},
+		},
+		Vulnerabilities:        make(map[string]clairVulnerability),
+		PackageVulnerabilities: make(map[string][]string),
+	}
+	for i, v := range vulns {
+		name, sev, _ := strings.Cut(v, ":")
+		vid := "v" + key(i)
+		rep.Vulnerabilities[vid] = clairVulnerability{Name: name, NormalizedSeverity: sev, FixedInVersion: "3.0.8"}
+		rep.PackageVulnerabilities[key(0)] = append(rep.PackageVulnerabilities[key(0)], vid)
+	}
+	return rep
+}
+
+func TestSummarize(t *testing.T) {
+	a := summarize(testReport(0, "CVE-1:High", "CVE-2:Bogus"))
+	if want := (Severities{High: 1, Unknown: 1}); a.Packages != 2 || a.Severities != want {
+		t.Errorf("summary: got: %+v", a)
+	}
+	if got, want := a.PackageList, []string{"openssl 3.0.7 (binary, source openssl 3.0.7)", "zlib 1.2.13 (binary)"}; !slices.Equal(got, want) {
+		t.Errorf("packages: got: %q, want: %q", got, want)
+	}
+	if got, want := a.VulnerabilityList[0].String(), "CVE-1 High in openssl 3.0.7 (binary, source openssl 3.0.7), fixed in 3.0.8"; got != want {
+		t.Errorf("vulnerability: got: %q, want: %q", got, want)
+	}
+	// The same report from another deployment, with other IDs.
+	if b := summarize(testReport(5, "CVE-1:High", "CVE-2:Bogus")); !reflect.DeepEqual(a, b) {
+		t.Errorf("renumbered report: got: %+v, want: %+v", b, a)
+	}
+	c := summarize(testReport(0, "CVE-1:Critical", "CVE-2:Bogus"))
+	if c.PackageHash != a.PackageHash || c.VulnerabilityHash == a.VulnerabilityHash {
+		t.Errorf("changed severity: got: %+v, from: %+v", c, a)
+	}
+}
+
+func TestVulns(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	var rs []*repoResult
+	for _, n := range []string{"a", "b", "c"} {
+		rs = append(rs, &repoResult{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", n}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:" + n}},
+		})
+	}
+	writeResults(t, w, rs)
+
+	var mu sync.Mutex
+	reports := map[string]*vulnerabilityReport{
+		"sha256:a": testReport(0),
+		"sha256:b": testReport(0, "CVE-1:High"),
+		"sha256:c": testReport(0),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		d, _ := strings.CutPrefix(r.URL.Path, "/matcher/api/v1/vulnerability_report/")
+		rep, ok := reports[d]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "not-found", "message": "no index report"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(rep)
+	}))
+	defer srv.Close()
+	for d, state := range map[string]string{"sha256:a": indexFinished, "sha256:b": indexFinished, "sha256:c": indexError} {
+		res := &indexResult{Digest: d, State: state, Submitted: time.Now()}
+		if err := insertIndexReport(conn, srv.URL, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	opts := VulnsOptions{Matcher: srv.URL, Indexer: srv.URL, Workers: 2, Label: "old"}
+	from, err := vulns(ctx, conn, srv.Client(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queryString(t, conn, `SELECT packages || ':' || high FROM vulnerability_report ORDER BY manifest;`), "2:0,2:1"; got != want {
+		t.Errorf("reports: got: %q, want: %q", got, want)
+	}
+	if got, want := queryString(t, conn, `SELECT count(*) FROM report_package;`), "4"; got != want {
+		t.Errorf("packages: got: %q, want: %q", got, want)
+	}
+	if got, want := queryString(t, conn, `SELECT vulnerability || ':' || severity FROM report_vulnerability;`), "CVE-1:High"; got != want {
+		t.Errorf("vulnerabilities: got: %q, want: %q", got, want)
+	}
+
+	// The next deployment lost a report and found more in another.
+	mu.Lock()
+	delete(reports, "sha256:a")
+	reports["sha256:b"] = testReport(3, "CVE-1:High", "CVE-3:Critical")
+	mu.Unlock()
+	opts.Label = "new"
+	to, err := vulns(ctx, conn, srv.Client(), opts)
+	if err == nil {
+		t.Error("missing report didn't fail")
+	}
+	if got, want := queryString(t, conn, `SELECT error FROM vulnerability_report WHERE error IS NOT NULL;`), "unexpected response: 404 Not Found: no index report"; got != want {
+		t.Errorf("error: got: %q, want: %q", got, want)
+	}
+
+	f, tr, err := pickReportRuns(conn, conn, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != from || tr.ID != to || f.Label != "old" || tr.Label != "new" {
+		t.Errorf("runs: got: %+v, %+v", f, tr)
+	}
+	c, err := compareRuns(conn, conn, f, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Removed) != 1 || c.Removed[0] != "sha256:a" {
+		t.Errorf("removed: got: %q", c.Removed)
+	}
+	if len(c.Changed) != 1 || c.Changed[0].Manifest != "sha256:b" || c.Changed[0].Packages || !c.Changed[0].Vulnerabilities {
+		t.Fatalf("changed: got: %+v", c.Changed)
+	}
+	ch := c.Changed[0]
+	want := []ReportVulnerability{{
+		Name:           "CVE-3",
+		Package:        "openssl 3.0.7 (binary, source openssl 3.0.7)",
+		FixedInVersion: "3.0.8",
+		Severity:       "Critical",
+	}}
+	if !slices.Equal(ch.AddedVulnerabilities, want) || len(ch.RemovedVulnerabilities) != 0 || len(ch.AddedPackages) != 0 {
+		t.Errorf("changed vulnerabilities: got: +%v -%v", ch.AddedVulnerabilities, ch.RemovedVulnerabilities)
+	}
+}
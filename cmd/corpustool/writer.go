@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// writer owns the crawl's only database connection and records what the
+// fetchers found.
+//
+// Results are committed in batches: a transaction is committed once it holds
+// "Batch" results or has been open for "Interval", whichever comes first. The
+// checkpoint is saved in the same transaction, so it never runs ahead of the
+// data.
+type writer struct {
+	conn  *sqlite.Conn
+	regID int64
+	runID int64
+	query string
+	cp    *checkpoint
+	// passRun is the run that started the current pass through the
+	// registry.
+	passRun int64
+
+	// Batch is the largest number of results committed at once.
+	Batch int
+	// Interval is the longest a result waits to be committed.
+	Interval time.Duration
+	// Budget is how many failed repositories are tolerated.
+	Budget ErrorBudget
+	// SkipCheckpoint leaves the crawl state alone, for crawls that don't
+	// page through the registry.
+	SkipCheckpoint bool
+
+	// namespaces and repositories cache the IDs of names already written.
+	// A failed commit can leave IDs here that were rolled back, but a
+	// failed commit also ends the crawl.
+	namespaces   map[string]int64
+	repositories map[string]int64
+	// committed is the number of results committed so far, and failed the
+	// number of those that were failures.
+	committed int
+	failed    int
+}
+
+// tagRow is the JSON form of a [Tag] handed to the tag queries. Unknown
+// metadata is left out, so that it's stored as NULL.
+type tagRow struct {
+	Name         string `json:"name"`
+	Digest       string `json:"digest"`
+	List         bool   `json:"list"`
+	Started      int64  `json:"start_ts,omitempty"`
+	LastModified int64  `json:"last_modified,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Expiration   int64  `json:"expiration,omitempty"`
+}
+
+func newTagRow(t *Tag) tagRow {
+	r := tagRow{
+		Name:   t.Name,
+		Digest: t.Digest,
+		List:   t.IsList,
+		Size:   t.Size,
+	}
+	if !t.Started.IsZero() {
+		r.Started = t.Started.Unix()
+	}
+	if !t.LastModified.IsZero() {
+		r.LastModified = t.LastModified.Unix()
+	}
+	if !t.Expiration.IsZero() {
+		r.Expiration = t.Expiration.Unix()
+	}
+	return r
+}
+
+// nameID returns the ID of "name", inserting it with the query "file" if it
+// is not in "cache".
+func (w *writer) nameID(cache map[string]int64, file, name string) (int64, error) {
+	if id, ok := cache[name]; ok {
+		return id, nil
+	}
+	id := int64(-1)
+	err := sqlitex.ExecuteFS(w.conn, sql.FS, file, &sqlitex.ExecOptions{
+		Args: []any{name},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return -1, err
+	}
+	cache[name] = id
+	return id, nil
+}
+
+// Run consumes "results" until it is closed or "ctx" is canceled. Results that
+// have already arrived are committed either way.
+func (w *writer) Run(ctx context.Context, results <-chan *repoResult) error {
+	w.namespaces = make(map[string]int64)
+	w.repositories = make(map[string]int64)
+	var batch []*repoResult
+	t := time.NewTicker(w.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				if err := w.commit(batch); err != nil {
+					return err
+				}
+				return w.checkBudget()
+			}
+			batch = append(batch, r)
+			if len(batch) < w.Batch {
+				continue
+			}
+		case <-t.C:
+		case <-ctx.Done():
+			// Keep anything that was fetched before the crawl stopped.
+		Drain:
+			for {
+				select {
+				case r, ok := <-results:
+					if !ok {
+						break Drain
+					}
+					batch = append(batch, r)
+				default:
+					break Drain
+				}
+			}
+			return errors.Join(w.commit(batch), context.Cause(ctx))
+		}
+		if err := w.commit(batch); err != nil {
+			return err
+		}
+		if err := w.checkBudget(); err != nil {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// commit writes "rs" and the resulting checkpoint in one transaction.
+func (w *writer) commit(rs []*repoResult) (err error) {
+	if len(rs) == 0 {
+		return nil
+	}
+	endFn, err := sqlitex.ImmediateTransaction(w.conn)
+	if err != nil {
+		return err
+	}
+	// The counts only include results that made it into the database, so
+	// they're added once the transaction is committed.
+	page, failed := 0, 0
+	defer func() {
+		endFn(&err)
+		if err == nil {
+			w.committed += len(rs)
+			w.failed += failed
+			slog.Debug("committed results", "count", len(rs), "failed", failed, "page", page)
+		}
+	}()
+
+	for _, r := range rs {
+		if err := w.write(r); err != nil {
+			return err
+		}
+		if r.Err != nil {
+			failed++
+		}
+		page = w.cp.Done(r.Page)
+	}
+	if !w.SkipCheckpoint {
+		if err := saveCheckpoint(w.conn, w.regID, w.query, page, w.passRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBudget reports an error if more repositories have failed than the
+// budget allows.
+func (w *writer) checkBudget() error {
+	if w.Budget.Exceeded(w.failed, w.committed) {
+		return fmt.Errorf("error budget exceeded: %d of %d repositories failed", w.failed, w.committed)
+	}
+	return nil
+}
+
+// write records a single result.
+func (w *writer) write(res *repoResult) error {
+	conn := w.conn
+	r := res.Repo
+	nsID, err := w.nameID(w.namespaces, "insert_namespace.sql", r.Namespace)
+	if err != nil {
+		return err
+	}
+	rID, err := w.nameID(w.repositories, "insert_repository.sql", r.Name)
+	if err != nil {
+		return err
+	}
+	// The repository was listed, so it's still there even if it couldn't be
+	// fetched.
+	err = sqlitex.ExecuteFS(conn, sql.FS, "insert_repository_seen.sql", &sqlitex.ExecOptions{
+		Args: []any{w.regID, nsID, rID, w.runID},
+	})
+	if err != nil {
+		return err
+	}
+	if res.Meta != nil {
+		if err := w.setRepoMeta(nsID, rID, res.Meta); err != nil {
+			return err
+		}
+	}
+
+	if res.Err != nil {
+		if err := w.insertFetchError(nsID, rID, res.Err); err != nil {
+			return err
+		}
+	}
+	if res.Err != nil || res.Skipped {
+		// Carry the repository's tags into this run as-is. For a failed
+		// repository, whether they're still there isn't known, so they
+		// mustn't be marked gone either.
+		for _, name := range []string{"copy_run_tags.sql", "set_repo_tags_run.sql"} {
+			err := sqlitex.ExecuteFS(conn, sql.FS, name, &sqlitex.ExecOptions{
+				Args: []any{w.runID, w.regID, nsID, rID},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The tags are passed as a single JSON array, so that a repository costs
+	// the same number of statements however many tags it has.
+	rows := make([]tagRow, len(res.Tags))
+	for i := range res.Tags {
+		rows[i] = newTagRow(&res.Tags[i])
+	}
+	b, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	tags := string(b)
+	for _, q := range []struct {
+		name string
+		args []any
+	}{
+		{"insert_tags.sql", []any{tags}},
+		{"insert_manifests.sql", []any{tags}},
+		{"insert_repo_tags.sql", []any{w.regID, nsID, rID, tags, w.runID}},
+		{"insert_run_tags.sql", []any{w.runID, w.regID, nsID, rID, tags}},
+	} {
+		err := sqlitex.ExecuteFS(conn, sql.FS, q.name, &sqlitex.ExecOptions{
+			Args: q.args,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, idx := range res.Indexes {
+		if err := insertIndex(conn, idx.Digest, idx.Index); err != nil {
+			return err
+		}
+	}
+	for _, m := range res.Manifests {
+		if err := insertLayers(conn, m.Digest, m.Manifest); err != nil {
+			return err
+		}
+	}
+	for _, d := range res.Distros {
+		if err := insertDistro(conn, d.Digest, d.imageDistro); err != nil {
+			return err
+		}
+	}
+	// Record the fetch even if there were no tags, so that empty
+	// repositories are also skipped on a re-run.
+	err = sqlitex.ExecuteFS(conn, sql.FS, "insert_repository_fetch.sql", &sqlitex.ExecOptions{
+		Args: []any{w.regID, nsID, rID},
+	})
+	if err != nil {
+		return err
+	}
+	return sqlitex.ExecuteFS(conn, sql.FS, "resolve_fetch_errors.sql", &sqlitex.ExecOptions{
+		Args: []any{w.runID, w.regID, nsID, rID},
+	})
+}
+
+// setRepoMeta records the metadata "m" for the repository "rID" in the
+// namespace "nsID".
+func (w *writer) setRepoMeta(nsID, rID int64, m *RepoMeta) error {
+	var mod any
+	if !m.LastModified.IsZero() {
+		mod = m.LastModified.Unix()
+	}
+	err := sqlitex.ExecuteFS(w.conn, sql.FS, "set_repository_meta.sql", &sqlitex.ExecOptions{
+		Args: []any{w.regID, nsID, rID, m.Description, m.Public, m.Kind, m.Popularity, mod},
+	})
+	if err != nil || m.NamespaceKind == "" {
+		return err
+	}
+	return sqlitex.ExecuteFS(w.conn, sql.FS, "insert_namespace_meta.sql", &sqlitex.ExecOptions{
+		Args: []any{w.regID, nsID, m.NamespaceKind},
+	})
+}
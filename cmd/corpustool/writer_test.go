@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quay/clair-workflows/cmd/corpustool/sql"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestWriter(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	w.Budget = ErrorBudget{Limit: 1}
+
+	m := &Manifest{
+		Config: Descriptor{Digest: "sha256:cfg"},
+		Layers: []Descriptor{{Digest: "sha256:l1", Size: 1}},
+	}
+	rs := []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:list", IsList: true, Size: 10}},
+			Indexes: []fetchedIndex{{
+				Digest: "sha256:list",
+				Index: &Index{Manifests: []Descriptor{{
+					MediaType: mediaTypeOCIManifest,
+					Digest:    "sha256:amd64",
+					Platform:  &Platform{OS: "linux", Architecture: "amd64"},
+				}}},
+			}},
+			Manifests: []fetchedManifest{{Digest: "sha256:amd64", Manifest: m}},
+			Distros: []fetchedDistro{{Digest: "sha256:amd64", imageDistro: &imageDistro{
+				Platform: Platform{OS: "linux", Architecture: "amd64"},
+				Release:  &osRelease{ID: "rhel", VersionID: "9.4"},
+				Layer:    Descriptor{Digest: "sha256:l1", Size: 1},
+			}}},
+		},
+		{
+			pagedRepo: pagedRepo{
+				Repo: Repo{"ns", "single"},
+				Page: 1,
+				Meta: &RepoMeta{Public: true, Popularity: 2, NamespaceKind: "organization"},
+			},
+			Tags: []Tag{{Name: "v1", Digest: "sha256:single"}},
+		},
+		{pagedRepo: pagedRepo{Repo: Repo{"ns", "empty"}, Page: 1}},
+		{pagedRepo: pagedRepo{Repo: Repo{"ns", "b"}, Page: 2}, Skipped: true},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "private"}, Page: 2},
+			Err:       &ResponseError{StatusCode: 403, Status: "403 Forbidden"},
+		},
+	}
+	writeResults(t, w, rs)
+
+	for _, tc := range []struct{ q, want string }{
+		{`SELECT ref FROM refs ORDER BY ref;`, "quay.io/ns/a:latest,quay.io/ns/single:v1"},
+		{`SELECT os || '/' || architecture FROM refs_by_platform;`, "linux/amd64"},
+		{`SELECT is_list FROM manifest WHERE digest = 'sha256:list';`, "1"},
+		{`SELECT kind FROM refs_by_kind ORDER BY ref;`, "list,single"},
+		{`SELECT coalesce(size, 'null') || ',' || coalesce(expiration, 'null') FROM repo_tag ORDER BY id;`, "10,null,null,null"},
+		{`SELECT count(*) FROM repository_fetch;`, "3"},
+		{`SELECT count(*) FROM run_tag;`, "2"},
+		{`SELECT DISTINCT first_run || ',' || last_run FROM repo_tag;`, "1,1"},
+		{`SELECT page FROM crawl_state;`, "2"},
+		{`SELECT status FROM fetch_error;`, "403"},
+		{`SELECT kind FROM namespace_meta;`, "organization"},
+		{`SELECT distro || ':' || version FROM manifest_release AS r JOIN manifest AS m ON (r.manifest = m.id) ORDER BY m.digest;`, "rhel:9.4,rhel:9.4"},
+	} {
+		if got := queryString(t, conn, tc.q); got != tc.want {
+			t.Errorf("%s: got: %q, want: %q", tc.q, got, tc.want)
+		}
+	}
+
+	k, err := loadKnown(conn, w.regID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := k.Children("sha256:list"), []string{"sha256:amd64"}; !slices.Equal(got, want) {
+		t.Errorf("children: got: %q, want: %q", got, want)
+	}
+	if k.ClaimList("sha256:list") {
+		t.Error("resolved list claimed again")
+	}
+	if k.ClaimManifest("sha256:amd64") {
+		t.Error("layered manifest claimed again")
+	}
+	if k.ClaimDistro("sha256:amd64") {
+		t.Error("classified manifest claimed again")
+	}
+	if rel, _ := k.LayerRelease("sha256:l1"); rel == nil || rel.ID != "rhel" {
+		t.Errorf("layer release: got: %+v", rel)
+	}
+	if k.FetchedAt(Repo{"ns", "empty"}) == 0 {
+		t.Error("empty repository not recorded as fetched")
+	}
+
+	refs, err := loadRefs(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs = filterRefs(refs, "", &Filter{PublicOnly: true, MinPopularity: 1})
+	if len(refs) != 2 || refs[0].Distro != "rhel" || refs[1].Meta == nil || refs[1].Meta.Popularity != 2 {
+		t.Errorf("filtered refs: got: %+v", refs)
+	}
+}
+
+func TestWriterLayersBeforeIndex(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	// One fetcher resolved the list, another fetched the child's layers, and
+	// a third classified it, but the results reached the writer in reverse.
+	rs := []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "c"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:list", IsList: true}},
+			Distros: []fetchedDistro{{Digest: "sha256:amd64", imageDistro: &imageDistro{
+				Platform: Platform{OS: "linux", Architecture: "amd64"},
+				Release:  &osRelease{ID: "rhel", VersionID: "9.4"},
+				Layer:    Descriptor{Digest: "sha256:l1", Size: 1},
+			}}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "b"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:list", IsList: true}},
+			Manifests: []fetchedManifest{{
+				Digest: "sha256:amd64",
+				Manifest: &Manifest{
+					Config: Descriptor{Digest: "sha256:cfg"},
+					Layers: []Descriptor{{Digest: "sha256:l1", Size: 1}},
+				},
+			}},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:list", IsList: true}},
+			Indexes: []fetchedIndex{{
+				Digest: "sha256:list",
+				Index: &Index{Manifests: []Descriptor{{
+					MediaType: mediaTypeOCIManifest,
+					Digest:    "sha256:amd64",
+					Platform:  &Platform{OS: "linux", Architecture: "amd64"},
+				}}},
+			}},
+		},
+	}
+	writeResults(t, w, rs)
+
+	for _, tc := range []struct{ q, want string }{
+		{`SELECT config FROM manifest WHERE digest = 'sha256:amd64';`, "sha256:cfg"},
+		{`SELECT l.digest FROM manifest AS m JOIN manifest_layer AS ml ON (ml.manifest = m.id) JOIN layer AS l ON (ml.layer = l.id) WHERE m.digest = 'sha256:amd64';`, "sha256:l1"},
+		{`SELECT os || '/' || architecture FROM refs_by_platform WHERE ref = 'quay.io/ns/b@sha256:amd64';`, "linux/amd64"},
+		{`SELECT d.distro || ':' || d.version || '@' || l.digest FROM manifest AS m JOIN image_distro AS d ON (d.manifest = m.id) JOIN layer AS l ON (d.layer = l.id) WHERE m.digest = 'sha256:amd64';`, "rhel:9.4@sha256:l1"},
+	} {
+		if got := queryString(t, conn, tc.q); got != tc.want {
+			t.Errorf("%s: got: %q, want: %q", tc.q, got, tc.want)
+		}
+	}
+}
+
+// newTestWriter returns a writer for a new run against the registry
+// "quay.io" in the database on "conn", migrating it if needed.
+func newTestWriter(t *testing.T, conn *sqlite.Conn) *writer {
+	t.Helper()
+	if err := migrate(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	var regID int64
+	err := sqlitex.ExecuteFS(conn, sql.FS, "insert_registry.sql", &sqlitex.ExecOptions{
+		Args: []any{"quay.io"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.ExecuteFS(conn, sql.FS, "get_registry_id.sql", &sqlitex.ExecOptions{
+		Args: []any{"quay.io"},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			regID = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runID, err := startRun(conn, regID, "https://quay.io/api/v1", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &writer{
+		conn:     conn,
+		regID:    regID,
+		runID:    runID,
+		query:    "*",
+		cp:       newCheckpoint(1),
+		passRun:  runID,
+		Batch:    2,
+		Interval: time.Hour,
+	}
+}
+
+// writeResults runs "w" over "rs".
+func writeResults(t *testing.T, w *writer, rs []*repoResult) {
+	t.Helper()
+	results := make(chan *repoResult, len(rs))
+	for _, r := range rs {
+		w.cp.Add(r.Page)
+		results <- r
+	}
+	close(results)
+	if err := w.Run(context.Background(), results); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queryString runs the query "q" and joins the first column of its results
+// with commas.
+func queryString(t *testing.T, conn *sqlite.Conn, q string) string {
+	t.Helper()
+	var out []string
+	err := sqlitex.ExecuteTransient(conn, q, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			out = append(out, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestWriterRollback(t *testing.T) {
+	conn := openTestDB(t)
+	w := newTestWriter(t, conn)
+	// Make the batch fail at COMMIT, after every result was written, with a
+	// deferred foreign key violation. The pragma is a no-op inside the
+	// script's savepoint, so it's run on its own.
+	err := sqlitex.ExecuteTransient(conn, `PRAGMA foreign_keys = ON;`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.ExecuteScript(conn, `
+CREATE TEMP TABLE parent (id INTEGER PRIMARY KEY);
+CREATE TEMP TABLE child (parent INTEGER REFERENCES parent (id) DEFERRABLE INITIALLY DEFERRED);
+CREATE TEMP TRIGGER fail_fetch AFTER INSERT ON repository_fetch BEGIN INSERT INTO child VALUES (1); END;
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.namespaces = make(map[string]int64)
+	w.repositories = make(map[string]int64)
+	rs := []*repoResult{
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "private"}, Page: 1},
+			Err:       &ResponseError{StatusCode: 403, Status: "403 Forbidden"},
+		},
+		{
+			pagedRepo: pagedRepo{Repo: Repo{"ns", "a"}, Page: 1},
+			Tags:      []Tag{{Name: "latest", Digest: "sha256:a"}},
+		},
+	}
+	for _, r := range rs {
+		w.cp.Add(r.Page)
+	}
+	if err := w.commit(rs); err == nil {
+		t.Fatal("commit didn't fail")
+	}
+	if w.committed != 0 || w.failed != 0 {
+		t.Errorf("counts: got: %d committed, %d failed", w.committed, w.failed)
+	}
+	if got := queryString(t, conn, `SELECT count(*) FROM fetch_error;`); got != "0" {
+		t.Errorf("fetch errors: got: %s, want: 0", got)
+	}
+
+	err = sqlitex.ExecuteTransient(conn, `DROP TRIGGER fail_fetch;`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clear(w.namespaces)
+	clear(w.repositories)
+	if err := w.commit(rs); err != nil {
+		t.Fatal(err)
+	}
+	if w.committed != 2 || w.failed != 1 {
+		t.Errorf("counts: got: %d committed, %d failed", w.committed, w.failed)
+	}
+}